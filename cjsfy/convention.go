@@ -0,0 +1,89 @@
+package cjsfy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+const defaultConvention = "{{to}}\n" + splitter + "\n{{text}}"
+
+var (
+	conventionMu      sync.Mutex
+	conventionPrompt  string
+	conventionPattern *regexp.Regexp
+)
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// compileConvention turns a prompt convention into a regexp, {{to}} and
+// {{text}} are the capturing groups, and the spaces around the literal parts
+// are ignored.
+func compileConvention(prompt string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`(?s)^\s*`)
+	seen := map[string]bool{}
+	last := 0
+	for _, loc := range placeholderPattern.FindAllStringSubmatchIndex(prompt, -1) {
+		name := prompt[loc[2]:loc[3]]
+		if (name != "to" && name != "text") || seen[name] {
+			return nil, fmt.Errorf("unexpected placeholder {{%s}} in the prompt convention", name)
+		}
+		literal := strings.TrimSpace(prompt[last:loc[0]])
+		if literal == "" && len(seen) > 0 {
+			return nil, fmt.Errorf("{{to}} and {{text}} should be separated in the prompt convention")
+		}
+		if literal != "" {
+			b.WriteString(regexp.QuoteMeta(literal) + `\s*`)
+		}
+		b.WriteString("(?P<" + name + ">.*?)" + `\s*`)
+		seen[name] = true
+		last = loc[1]
+	}
+	if len(seen) != 2 {
+		return nil, fmt.Errorf("the prompt convention should contain {{to}} and {{text}}")
+	}
+	if literal := strings.TrimSpace(prompt[last:]); literal != "" {
+		b.WriteString(regexp.QuoteMeta(literal) + `\s*`)
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// convention returns the pattern of the configured prompt convention, it
+// falls back to the default one if the configured is invalid.
+func convention() *regexp.Regexp {
+	prompt := config.ReadConfig().Cjsfy.Prompt
+	if prompt == "" {
+		prompt = defaultConvention
+	}
+	conventionMu.Lock()
+	defer conventionMu.Unlock()
+	if conventionPattern != nil && conventionPrompt == prompt {
+		return conventionPattern
+	}
+	pattern, err := compileConvention(prompt)
+	if err != nil {
+		log.Errorf("bad prompt convention %q, use the default: %s", prompt, err)
+		pattern, _ = compileConvention(defaultConvention)
+	}
+	conventionPrompt, conventionPattern = prompt, pattern
+	return pattern
+}
+
+// parseConvention extracts the target language and the text from a message
+// in the prompt convention.
+func parseConvention(msg string) (to string, text string, ok bool) {
+	pattern := convention()
+	m := pattern.FindStringSubmatch(msg)
+	if m == nil {
+		return "", "", false
+	}
+	to = strings.TrimSpace(m[pattern.SubexpIndex("to")])
+	text = strings.TrimSpace(m[pattern.SubexpIndex("text")])
+	return to, text, to != "" && text != ""
+}
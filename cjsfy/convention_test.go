@@ -0,0 +1,42 @@
+package cjsfy
+
+import (
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+func TestParseConvention(t *testing.T) {
+	cases := []struct {
+		msg  string
+		to   string
+		text string
+		ok   bool
+	}{
+		{"英语\n" + splitter + "\n你好", "英语", "你好", true},
+		{"  英语  " + splitter + "你好\n世界 ", "英语", "你好\n世界", true},
+		{"你好", "", "", false},
+	}
+	for _, c := range cases {
+		to, text, ok := parseConvention(c.msg)
+		if to != c.to || text != c.text || ok != c.ok {
+			t.Errorf("bad result of %q: %q, %q, %v", c.msg, to, text, ok)
+		}
+	}
+
+	config.ReadConfig().Cjsfy.Prompt = "Translate into {{to}}:\n{{text}}"
+	t.Cleanup(func() {
+		config.ReadConfig().Cjsfy.Prompt = ""
+	})
+	if to, text, ok := parseConvention("Translate into French:\nhello"); to != "French" || text != "hello" || !ok {
+		t.Errorf("bad result of the custom convention: %q, %q, %v", to, text, ok)
+	}
+}
+
+func TestCompileConvention(t *testing.T) {
+	for _, prompt := range []string{"{{text}}", "{{to}}{{text}}", "{{to}} {{from}} {{text}}"} {
+		if _, err := compileConvention(prompt); err == nil {
+			t.Errorf("expect an error of the convention %q", prompt)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package cjsfy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/go-chi/render"
+	"github.com/zjx20/hcfy-gemini/translate"
+	"github.com/zjx20/hcfy-gemini/util/lang"
+)
+
+// authorized checks the password, which can also be given as the API key of
+// the Gemini API.
+func authorized(r *http.Request) bool {
+	token := os.Getenv("PASSWORD")
+	if token == "" {
+		return true
+	}
+	q := r.URL.Query()
+	return q.Get("pass") == token || q.Get("key") == token || r.Header.Get("x-goog-api-key") == token
+}
+
+var statusNames = map[int]string{
+	http.StatusBadRequest:          "INVALID_ARGUMENT",
+	http.StatusForbidden:           "PERMISSION_DENIED",
+	http.StatusTooManyRequests:     "RESOURCE_EXHAUSTED",
+	http.StatusInternalServerError: "INTERNAL",
+	http.StatusServiceUnavailable:  "UNAVAILABLE",
+	http.StatusGatewayTimeout:      "DEADLINE_EXCEEDED",
+}
+
+// renderError responds a google.rpc.Status, like the Gemini API does.
+func renderError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	render.Status(r, code)
+	render.JSON(w, r, &ErrorResponse{
+		Error: &Status{
+			Code:    code,
+			Message: msg,
+			Status:  statusNames[code],
+		},
+	})
+}
+
+// errorCode is the HTTP status of a translation error.
+func errorCode(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	switch class, _ := translate.Classify(err); class {
+	case translate.ErrRateLimited:
+		return http.StatusTooManyRequests
+	case translate.ErrRetryable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// translation is a text to translate, taken from a part of the request.
+type translation struct {
+	to   string
+	text string
+}
+
+// parseRequest takes the text parts of the last user content. A part in the
+// prompt convention carries its own target language, otherwise the language
+// is given by the "to" query, or found in the system instruction.
+func parseRequest(req *GeminiAPIRequest, to string) ([]*translation, error) {
+	var last *Content
+	for _, c := range req.Contents {
+		if c != nil && (c.Role == "" || c.Role == "user") {
+			last = c
+		}
+	}
+	if last == nil {
+		return nil, fmt.Errorf("no user content in the request")
+	}
+	if to == "" && req.SystemInstruction != nil {
+		for _, p := range req.SystemInstruction.Parts {
+			if to = targetLanguage(p.Text); to != "" {
+				break
+			}
+		}
+	}
+	var result []*translation
+	for _, p := range last.Parts {
+		if p == nil || strings.TrimSpace(p.Text) == "" {
+			continue
+		}
+		t, err := translationOf(p.Text, to)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no text to translate")
+	}
+	return result, nil
+}
+
+// translationOf takes the target language and the text from a message in
+// the prompt convention, or translates the whole message to the given
+// language.
+func translationOf(msg string, to string) (*translation, error) {
+	if convTo, text, ok := parseConvention(msg); ok {
+		return &translation{to: convTo, text: text}, nil
+	}
+	if to == "" {
+		return nil, fmt.Errorf("unknown target language, follow the prompt convention, " +
+			"use the \"to\" query, or tell it in the system prompt")
+	}
+	return &translation{to: to, text: strings.TrimSpace(msg)}, nil
+}
+
+var targetPattern = regexp.MustCompile(`(?i)\b(?:into|to)\s+|翻译成|翻译为|译成|译为|翻成`)
+
+// targetLanguage finds the target language in an instruction, such as
+// "Translate the text into Simplified Chinese" or "请翻译成日语", returns
+// the hcfy name of the language, or empty if not found.
+func targetLanguage(instruction string) string {
+	for _, loc := range targetPattern.FindAllStringIndex(instruction, -1) {
+		rest, _, _ := strings.Cut(instruction[loc[1]:], "\n")
+		if l := languageAt(rest); l != nil {
+			return l.Name
+		}
+	}
+	return ""
+}
+
+// languageAt looks up the language at the beginning of s, the longest name
+// wins.
+func languageAt(s string) *lang.Language {
+	var candidates []string
+	words := strings.Fields(s)
+	for n := min(3, len(words)); n > 0; n-- {
+		c := strings.TrimRightFunc(strings.Join(words[:n], " "), func(r rune) bool {
+			return r != ')' && r != '）' && (unicode.IsPunct(r) || unicode.IsSymbol(r))
+		})
+		// a bare lower case code is more likely an ordinary word, e.g. "it"
+		if lang.IsCode(c) && c == strings.ToLower(c) && !strings.Contains(c, "-") {
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	han := []rune(strings.TrimSpace(s))
+	for i, r := range han {
+		if !unicode.Is(unicode.Han, r) && !strings.ContainsRune("()（）", r) {
+			han = han[:i]
+			break
+		}
+	}
+	for n := min(8, len(han)); n >= 2; n-- {
+		candidates = append(candidates, string(han[:n]))
+	}
+	for _, c := range candidates {
+		if l := lang.Lookup(c); l != nil {
+			return l
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package cjsfy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTargetLanguage(t *testing.T) {
+	cases := map[string]string{
+		"Translate the following text into Simplified Chinese.": "中文(简体)",
+		"You are a translator, translate it to Japanese only":   "日语",
+		"请将用户的输入翻译成日语，不要解释":                                     "日语",
+		"翻译为 English":                 "英语",
+		"translate to zh-TW":          "中文(繁体)",
+		"Say hello to it":             "",
+		"You are a helpful assistant": "",
+	}
+	for instruction, expect := range cases {
+		if actual := targetLanguage(instruction); actual != expect {
+			t.Errorf("bad language of %q, expected: %q, actual: %q", instruction, expect, actual)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	req := &GeminiAPIRequest{
+		SystemInstruction: &Content{Parts: []*Part{{Text: "Translate into French."}}},
+		Contents: []*Content{
+			{Role: "user", Parts: []*Part{{Text: "ignored"}}},
+			{Role: "model", Parts: []*Part{{Text: "ignored"}}},
+			{Role: "user", Parts: []*Part{
+				{Text: "hello"},
+				{Text: ""},
+				{Text: "德语\n" + splitter + "\nworld"},
+			}},
+		},
+	}
+	translations, err := parseRequest(req, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expect := []*translation{{to: "法语", text: "hello"}, {to: "德语", text: "world"}}
+	if !reflect.DeepEqual(translations, expect) {
+		t.Errorf("bad translations, expected: %+v, actual: %+v", expect, translations)
+	}
+
+	translations, err = parseRequest(req, "英语")
+	if err != nil || translations[0].to != "英语" {
+		t.Errorf("the query should override the instruction: %+v, %v", translations, err)
+	}
+
+	req.SystemInstruction = nil
+	if _, err := parseRequest(req, ""); err == nil {
+		t.Errorf("expect an error without the target language")
+	}
+}
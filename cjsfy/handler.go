@@ -4,125 +4,76 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
 	"github.com/zjx20/hcfy-gemini/translate"
-	"github.com/zjx20/hcfy-gemini/util/tokenbucket"
 )
 
 const splitter = "-----splitter-----"
 
-var tokenBucket = tokenbucket.NewAdaptiveTokenBucket(60, 60,
-	tokenbucket.ProductionRule{
-		Interval:  1 * time.Minute,
-		Increment: 60,
-	},
-	[]tokenbucket.ConsumptionRule{
-		{
-			RestThreshold: 40,
-			Wait:          0,
-			RuleID:        1,
-		},
-		{
-			RestThreshold: 30,
-			Wait:          100 * time.Millisecond,
-			RuleID:        2,
-		},
-		{
-			RestThreshold: 20,
-			Wait:          500 * time.Millisecond,
-			RuleID:        3,
-		},
-		{
-			RestThreshold: 10,
-			Wait:          2000 * time.Millisecond,
-			RuleID:        4,
-		},
-		{
-			RestThreshold: 0,
-			Wait:          3000 * time.Millisecond,
-			RuleID:        5,
-		},
-	},
-)
+var tokenBucket = translate.NewTokenBucket()
 
 var mergeRules = []struct {
-	roleID   int
-	maxBytes int
+	roleID    int
+	maxTokens int
 }{
-	{1, 600},
-	{2, 1200},
-	{3, 1500},
-	{4, 1800},
-	{5, 2000},
+	{1, 200},
+	{2, 400},
+	{3, 500},
+	{4, 600},
+	{5, 700},
 }
 
-func mergeMaxBytes(ruleID int) int {
+// mergeMaxTokens is the token cap of a batch under the rule of the token
+// bucket, it can be overridden by "cjsfy.merge_tokens".
+func mergeMaxTokens(ruleID int) int {
+	if n := config.ReadConfig().Cjsfy.MergeTokens[ruleID]; n > 0 {
+		return n
+	}
 	for _, x := range mergeRules {
 		if x.roleID == ruleID {
-			return x.maxBytes
+			return x.maxTokens
 		}
 	}
-	return mergeRules[len(mergeRules)-1].maxBytes
+	return mergeRules[len(mergeRules)-1].maxTokens
 }
 
 var inputCh = make(chan *request) // no buffer
 
 type request struct {
-	text     string
-	to       string
+	text string
+	to   string
+	// opts is the model and the generation parameters given by the request,
+	// can be nil
+	opts     *translate.Translate2Options
 	cancelCh chan struct{}
 	respCh   chan *response
+	// paraCh receives the translated segments of text as soon as they are
+	// parsed from the streamed output, if not nil. Index is the position of
+	// the segment in text, every segment is sent at most once, and the
+	// response has the same text.
+	paraCh chan *translate.Paragraph
 }
 
-type response struct {
-	translatedText string
-}
+// keepSymbol separates the segments of a request text, they are translated
+// as separate paragraphs.
+const keepSymbol = "<Keep This Symbol>"
 
-func translateRuntine(input <-chan *request) {
-	var nextHeadReq *request
-	for {
-		req := nextHeadReq
-		nextHeadReq = nil
-		if req == nil {
-			req = <-input
-		}
-		ruleID, err := tokenBucket.Consume(context.Background())
-		if err != nil {
-			log.Errorf("translateRuntine exit, err: %v", err)
-			return
-		}
-		maxBytes := mergeMaxBytes(ruleID)
-		var requests []*request
-		time.Sleep(300 * time.Millisecond) // wait for more incoming requests
-		requests, nextHeadReq = collect(req, maxBytes, input)
-		go handleRequests(requests, false)
-	}
+func (r *request) segments() []string {
+	return strings.Split(r.text, keepSymbol)
 }
 
-func collect(headReq *request, maxBytes int, input <-chan *request) ([]*request, *request) {
-	requests := []*request{headReq}
-	sum := len(headReq.text)
-	to := headReq.to
-	done := false
-	for !done && sum < maxBytes {
-		select {
-		case req := <-input:
-			if req.to != to {
-				return requests, req
-			}
-			sum += len(req.text)
-			requests = append(requests, req)
-		default:
-			done = true
-		}
-	}
-	return requests, nil
+type response struct {
+	translatedText string
+	// segments is the translation of every segment of the request text
+	segments []string
+	err      error
 }
 
 func allCanceledCh(requests []*request) <-chan struct{} {
@@ -146,142 +97,228 @@ func allCanceledCh(requests []*request) <-chan struct{} {
 func handleRequests(requests []*request, needToken bool) {
 	log.Debugf("handleRequests len: %d", len(requests))
 	doneCh := allCanceledCh(requests)
-	for {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-doneCh
+		cancel()
+	}()
+
+	type holder struct {
+		req    *request
+		offset int
+		sent   []bool
+	}
+	var holders []*holder
+	var mapping []int
+	var input []string
+	stream := false
+	for idx, r := range requests {
+		h := &holder{req: r, offset: len(input)}
+		for _, x := range r.segments() {
+			input = append(input, strings.TrimSpace(x))
+			mapping = append(mapping, idx)
+		}
+		h.sent = make([]bool, len(input)-h.offset)
+		holders = append(holders, h)
+		stream = stream || r.paraCh != nil
+	}
+	// translated are the translations of input, a streamed segment is final,
+	// the retries don't request it again
+	translated := make([]string, len(input))
+	// forward sends a streamed paragraph to its request, idx is the index in
+	// input
+	forward := func(idx int, text string) {
+		h := holders[mapping[idx]]
+		if local := idx - h.offset; h.req.paraCh != nil && !h.sent[local] {
+			h.sent[local] = true
+			translated[idx] = text
+			h.req.paraCh <- &translate.Paragraph{Index: local, Text: text}
+		}
+	}
+	respond := func() {
+		for _, h := range holders {
+			segments := translated[h.offset : h.offset+len(h.sent)]
+			h.req.respCh <- &response{
+				translatedText: strings.Join(segments, "\n"+keepSymbol+"\n"),
+				segments:       segments,
+			}
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		// pending are the indexes of the segments to translate
+		var pending []int
+		for idx := range input {
+			if h := holders[mapping[idx]]; !h.sent[idx-h.offset] {
+				pending = append(pending, idx)
+			}
+		}
+		if len(pending) == 0 {
+			respond()
+			return
+		}
+		pendingInput := make([]string, len(pending))
+		for i, idx := range pending {
+			pendingInput[i] = input[idx]
+		}
+
 		if needToken {
-			_, err := tokenBucket.Consume(context.Background())
+			_, err := tokenBucket.Consume(ctx)
 			if err != nil {
 				return
 			}
 		}
 		needToken = true
 
-		type holder struct {
-			req    *request
-			result []string
+		ch := make(chan *translate.TranslateResult, 1)
+		var paraCh chan *translate.Paragraph
+		if stream {
+			paraCh = make(chan *translate.Paragraph, len(pending))
 		}
-		var holders []*holder
-
-		var mapping []int
-		var input []string
-		for idx, r := range requests {
-			holders = append(holders, &holder{req: r})
-			for _, x := range strings.Split(r.text, "<Keep This Symbol>") {
-				input = append(input, strings.TrimSpace(x))
-				mapping = append(mapping, idx)
+		translate.Translate2Stream(ctx, pendingInput, requests[0].to, requests[0].opts, ch, paraCh)
+		var err error
+	wait:
+		for {
+			select {
+			case <-doneCh:
+				return
+			case p := <-paraCh:
+				forward(pending[p.Index], p.Text)
+			case result := <-ch:
+				for len(paraCh) > 0 {
+					p := <-paraCh
+					forward(pending[p.Index], p.Text)
+				}
+				if result.Err != nil {
+					err = result.Err
+					break wait
+				}
+				if len(result.Resp.Result) != len(pending) {
+					err = fmt.Errorf("number of translation result (%d) doesn't match the request (%d)",
+						len(result.Resp.Result), len(pending))
+					break wait
+				}
+				for i, idx := range pending {
+					translated[idx] = result.Resp.Result[i]
+				}
+				respond()
+				return
 			}
 		}
-		ch := make(chan *translate.TranslateResult, 1)
-		translate.Translate2(input, requests[0].to, ch)
-		select {
-		case <-doneCh:
-			return
-		case result := <-ch:
-			if result.Err != nil {
-				log.Errorf("translate error: %s", result.Err)
-				// retry
-				break
-			}
-			if len(result.Resp.Result) != len(input) {
-				log.Errorf("number of translation result (%d) doesn't match the request (%d)",
-					len(result.Resp.Result), len(input))
-				// retry
-				break
-			}
-			for idx, result := range result.Resp.Result {
-				holderIdx := mapping[idx]
-				holder := holders[holderIdx]
-				holder.result = append(holder.result, result)
-			}
+
+		delay, retry := translate.RetryDelay(err, attempt)
+		class, _ := translate.Classify(err)
+		if !retry {
+			log.Errorf("translate error (%s), give up after %d attempts: %s", class, attempt, err)
 			for _, holder := range holders {
-				holder.req.respCh <- &response{
-					translatedText: strings.Join(holder.result, "\n<Keep This Symbol>\n"),
-				}
+				holder.req.respCh <- &response{err: err}
 			}
 			return
 		}
+		log.Errorf("translate error (%s), retry in %s: %s", class, delay, err)
+		if !translate.Sleep(ctx, delay) {
+			return
+		}
 	}
 }
 
 func init() {
-	go translateRuntine(inputCh)
+	go runLanes(inputCh)
 }
 
-func Handle(w http.ResponseWriter, r *http.Request) {
-	if token := os.Getenv("PASSWORD"); token != "" {
-		if r.URL.Query().Get("pass") != token {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("bad password"))
-			return
-		}
+// decodeRequest decodes and checks the request, the error is responded if
+// it fails.
+func decodeRequest(w http.ResponseWriter, r *http.Request) ([]*translation, *translate.Translate2Options, bool) {
+	if !authorized(r) {
+		renderError(w, r, http.StatusForbidden, "bad password")
+		return nil, nil, false
 	}
 	req := &GeminiAPIRequest{}
 	if err := render.Decode(r, req); err != nil {
 		log.Debugf("bad request: %s", err)
-		render.Status(r, http.StatusBadRequest)
-		render.PlainText(w, r, err.Error())
-		return
+		renderError(w, r, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+	translations, err := parseRequest(req, r.URL.Query().Get("to"))
+	if err != nil {
+		log.Errorf("bad request: %s", err)
+		renderError(w, r, http.StatusBadRequest, err.Error())
+		return nil, nil, false
 	}
+	return translations, newOptions(chi.URLParam(r, "model"), req.GenerationConfig.toConfig()), true
+}
 
-	if len(req.Contents) != 1 || len(req.Contents[0].Parts) != 1 {
-		log.Errorf("bad request: %+v", req)
-		render.Status(r, http.StatusBadRequest)
-		render.PlainText(w, r, "expect Contents and Contents[0].Parts has only one element")
-		return
+// submit puts the translations into the merging queue, the requests are
+// canceled once cancelCh is closed.
+func submit(ctx context.Context, translations []*translation, opts *translate.Translate2Options,
+	cancelCh chan struct{}, stream bool) ([]*request, error) {
+	requests := make([]*request, len(translations))
+	for idx, t := range translations {
+		log.Debugf("cjsfy request, to: %s text: %s", t.to, t.text)
+		requests[idx] = &request{
+			text:     t.text,
+			to:       t.to,
+			opts:     opts,
+			cancelCh: cancelCh,
+			respCh:   make(chan *response, 1),
+		}
+		if stream {
+			requests[idx].paraCh = make(chan *translate.Paragraph, len(requests[idx].segments()))
+		}
+		select {
+		case inputCh <- requests[idx]:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	input := req.Contents[0].Parts[0].Text
-	parts := strings.Split(input, splitter)
-	if len(parts) != 2 {
-		log.Errorf("bad text input: %+v", input)
-		render.Status(r, http.StatusBadRequest)
-		render.PlainText(w, r, "expect Contents[0].Parts[0].Text has two parts")
+	return requests, nil
+}
+
+// Handle serves the generateContent method of the Gemini API. The text parts
+// of the last user content are translated, and answered as the parts of the
+// candidate in the same order.
+func Handle(w http.ResponseWriter, r *http.Request) {
+	translations, opts, ok := decodeRequest(w, r)
+	if !ok {
 		return
 	}
-	to := strings.TrimSpace(parts[0])
-	text := strings.TrimSpace(parts[1])
-	respCh := make(chan *response, 1)
-	cancelCh := make(chan struct{})
-	defer close(cancelCh)
-
-	log.Debugf("cjsfy request, to: %s text: %s", to, text)
-
 	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
 	defer cancel()
 
-	transReq := &request{
-		text:     text,
-		to:       to,
-		cancelCh: cancelCh,
-		respCh:   respCh,
-	}
-	select {
-	case inputCh <- transReq:
-	case <-ctx.Done():
-		render.Status(r, http.StatusInternalServerError)
-		render.PlainText(w, r, fmt.Sprintf("Internal Server Error: %s", ctx.Err()))
+	cancelCh := make(chan struct{})
+	defer close(cancelCh)
+	requests, err := submit(ctx, translations, opts, cancelCh, false)
+	if err != nil {
+		renderError(w, r, http.StatusGatewayTimeout, err.Error())
 		return
 	}
 
-	select {
-	case result := <-respCh:
-		log.Debugf("cjsfy get response, translated text: %s", result.translatedText)
-		resp := &GeminiAPIResponse{
-			Candidates: []*Candidate{
-				{
-					Content: &Content{
-						Parts: []*Part{
-							{
-								Text: result.translatedText,
-							},
-						},
-					},
-				},
-			},
+	parts := make([]*Part, len(requests))
+	for idx, transReq := range requests {
+		select {
+		case result := <-transReq.respCh:
+			if result.err != nil {
+				renderError(w, r, errorCode(result.err), result.err.Error())
+				return
+			}
+			log.Debugf("cjsfy get response, translated text: %s", result.translatedText)
+			parts[idx] = &Part{Text: result.translatedText}
+		case <-ctx.Done():
+			renderError(w, r, http.StatusGatewayTimeout, ctx.Err().Error())
+			return
 		}
-		render.JSON(w, r, resp)
-		return
-	case <-ctx.Done():
-		render.Status(r, http.StatusInternalServerError)
-		render.PlainText(w, r, fmt.Sprintf("Internal Server Error: %s", ctx.Err()))
-		return
 	}
+	render.JSON(w, r, &GeminiAPIResponse{
+		Candidates: []*Candidate{
+			{
+				Content: &Content{
+					Role:  "model",
+					Parts: parts,
+				},
+				FinishReason: "STOP",
+			},
+		},
+		ModelVersion: chi.URLParam(r, "model"),
+	})
 }
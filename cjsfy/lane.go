@@ -0,0 +1,229 @@
+package cjsfy
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+	"github.com/zjx20/hcfy-gemini/translate"
+)
+
+const (
+	// a batch waits this long for more requests before it's translated, if
+	// "cjsfy.max_wait" is not set
+	defaultMaxWait = 300 * time.Millisecond
+	// a lane is removed once it's idle for this long
+	laneIdle = time.Minute
+)
+
+// newOptions makes the options of a request. The model is only taken if it's
+// listed in "cjsfy.models", otherwise the configured model is used.
+func newOptions(model string, gen *config.GenerationConfig) *translate.Translate2Options {
+	model = strings.TrimPrefix(model, "models/")
+	if !slices.Contains(config.ReadConfig().Cjsfy.Models, model) {
+		model = ""
+	}
+	if model == "" && gen == nil {
+		return nil
+	}
+	return &translate.Translate2Options{Model: model, Generation: gen}
+}
+
+// laneKey groups the requests that can be merged into a batch.
+type laneKey struct {
+	to    string
+	model string
+	// gen is the generation parameters in JSON
+	gen string
+}
+
+func keyOf(r *request) laneKey {
+	key := laneKey{to: r.to}
+	if r.opts != nil {
+		key.model = r.opts.Model
+		if r.opts.Generation != nil {
+			data, _ := json.Marshal(r.opts.Generation)
+			key.gen = string(data)
+		}
+	}
+	return key
+}
+
+// lane merges the requests of a key into batches. The queue is unbounded,
+// so that a lane waiting for the token bucket never blocks the dispatcher.
+type lane struct {
+	key   laneKey
+	mu    sync.Mutex
+	queue []*request
+	// ready is signaled once a request is queued
+	ready chan struct{}
+	quit  chan struct{}
+}
+
+func newLane(key laneKey) *lane {
+	return &lane{
+		key:   key,
+		ready: make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+	}
+}
+
+func (l *lane) push(req *request) {
+	l.mu.Lock()
+	l.queue = append(l.queue, req)
+	l.mu.Unlock()
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the first queued request, the canceled ones are dropped. It
+// returns nil if the queue is empty.
+func (l *lane) pop() *request {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.queue) > 0 {
+		req := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		select {
+		case <-req.cancelCh:
+			continue
+		default:
+		}
+		return req
+	}
+	return nil
+}
+
+func (l *lane) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue)
+}
+
+// runLanes dispatches the requests to the lanes by their keys. The lanes
+// merge the requests independently, so that a request for another language
+// doesn't cut the batch short, while they share the token bucket.
+func runLanes(input <-chan *request) {
+	lanes := map[laneKey]*lane{}
+	retire := make(chan *lane)
+	for {
+		select {
+		case req := <-input:
+			key := keyOf(req)
+			l, ok := lanes[key]
+			if !ok {
+				l = newLane(key)
+				lanes[key] = l
+				go l.run(retire)
+				log.Debugf("new lane %+v, %d lanes", key, len(lanes))
+			}
+			l.push(req)
+		case l := <-retire:
+			// the lane may have got a request in the meantime
+			if l.len() == 0 {
+				delete(lanes, l.key)
+				close(l.quit)
+			}
+		}
+	}
+}
+
+func (l *lane) run(retire chan<- *lane) {
+	for {
+		head := l.pop()
+		if head == nil {
+			select {
+			case <-l.ready:
+			case <-time.After(laneIdle):
+				select {
+				case retire <- l:
+				case <-l.ready:
+					continue
+				}
+				select {
+				case <-l.ready:
+				case <-l.quit:
+					return
+				}
+			}
+			continue
+		}
+		ruleID, err := tokenBucket.Consume(context.Background())
+		if err != nil {
+			log.Errorf("lane %+v exit, err: %v", l.key, err)
+			return
+		}
+		go handleRequests(l.collect(head, ruleID), false)
+	}
+}
+
+// batchWindow is how long a batch waits for more requests. In the adaptive
+// mode, a batch is sent right away if the quota is plenty (rule 1) and
+// nothing else is queued, and it waits longer as the quota becomes scarce,
+// up to max_wait under the last rule, to merge more requests into a call.
+func batchWindow(cfg *config.CjsfyConfig, ruleID int, light bool) time.Duration {
+	maxWait := time.Duration(cfg.MaxWait) * time.Millisecond
+	if maxWait <= 0 {
+		maxWait = defaultMaxWait
+	}
+	if !cfg.Adaptive {
+		return maxWait
+	}
+	if ruleID < 1 || ruleID > len(mergeRules) {
+		ruleID = len(mergeRules)
+	}
+	if ruleID == 1 && light {
+		return 0
+	}
+	return maxWait * time.Duration(ruleID) / time.Duration(len(mergeRules))
+}
+
+// collect merges the requests following headReq, until the batch is full by
+// the caps, or the batch window is over. ruleID is the rule of the token
+// bucket that the batch is sent under.
+func (l *lane) collect(headReq *request, ruleID int) []*request {
+	cfg := config.ReadConfig().Cjsfy
+	maxTokens := mergeMaxTokens(ruleID)
+	requests := []*request{headReq}
+	sum := translate.EstimateTokens(headReq.text)
+	full := func() bool {
+		return sum >= maxTokens || (cfg.MaxBatch > 0 && len(requests) >= cfg.MaxBatch)
+	}
+	add := func(req *request) {
+		sum += translate.EstimateTokens(req.text)
+		requests = append(requests, req)
+	}
+	// take the queued requests
+	drain := func() {
+		for !full() {
+			req := l.pop()
+			if req == nil {
+				return
+			}
+			add(req)
+		}
+	}
+	drain()
+	window := time.NewTimer(batchWindow(&cfg, ruleID, len(requests) == 1))
+	defer window.Stop()
+	for !full() {
+		if cfg.MinBatch > 0 && len(requests) >= cfg.MinBatch && l.len() == 0 {
+			return requests
+		}
+		select {
+		case <-l.ready:
+			drain()
+		case <-window.C:
+			return requests
+		}
+	}
+	return requests
+}
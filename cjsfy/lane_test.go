@@ -0,0 +1,114 @@
+package cjsfy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zjx20/hcfy-gemini/config"
+	"github.com/zjx20/hcfy-gemini/translate"
+)
+
+func TestKeyOf(t *testing.T) {
+	temperature := float32(0.5)
+	gen := &config.GenerationConfig{Temperature: &temperature}
+	a := &request{to: "英语"}
+	b := &request{to: "英语", opts: &translate.Translate2Options{Generation: gen}}
+	c := &request{to: "日语"}
+	if keyOf(a) == keyOf(b) || keyOf(a) == keyOf(c) {
+		t.Errorf("the requests should be in different lanes")
+	}
+	if keyOf(a) != keyOf(&request{to: "英语", text: "hello"}) {
+		t.Errorf("the requests should be in the same lane")
+	}
+}
+
+func TestCollect(t *testing.T) {
+	config.ReadConfig().Cjsfy = config.CjsfyConfig{MergeTokens: map[int]int{1: 100, 2: 2}}
+	t.Cleanup(func() {
+		config.ReadConfig().Cjsfy = config.CjsfyConfig{}
+	})
+	l := newLane(laneKey{})
+	for _, text := range []string{"b", "c", "d"} {
+		l.push(&request{text: text})
+	}
+	requests := l.collect(&request{text: "a"}, 1)
+	if len(requests) != 4 {
+		t.Errorf("the queued requests should be merged, got %d", len(requests))
+	}
+
+	l.push(&request{text: "b"})
+	l.push(&request{text: "c"})
+	requests = l.collect(&request{text: "a"}, 2)
+	if len(requests) != 2 || l.len() != 1 {
+		t.Errorf("the batch should be sent once it's full, got %d", len(requests))
+	}
+	l.pop()
+
+	config.ReadConfig().Cjsfy.MaxBatch = 2
+	l.push(&request{text: "b"})
+	l.push(&request{text: "c"})
+	requests = l.collect(&request{text: "a"}, 1)
+	if len(requests) != 2 {
+		t.Errorf("the batch should have at most max_batch requests, got %d", len(requests))
+	}
+	l.pop()
+
+	config.ReadConfig().Cjsfy.MaxWait = 10000
+	config.ReadConfig().Cjsfy.MinBatch = 2
+	l.push(&request{text: "b"})
+	start := time.Now()
+	requests = l.collect(&request{text: "a"}, 1)
+	if len(requests) != 2 || time.Since(start) > time.Second {
+		t.Errorf("the batch should be sent once it has min_batch requests, got %d", len(requests))
+	}
+}
+
+func TestBatchWindow(t *testing.T) {
+	cfg := &config.CjsfyConfig{}
+	if w := batchWindow(cfg, 1, true); w != defaultMaxWait {
+		t.Errorf("bad default window: %s", w)
+	}
+	cfg = &config.CjsfyConfig{MaxWait: 200, Adaptive: true}
+	cases := []struct {
+		ruleID int
+		light  bool
+		expect time.Duration
+	}{
+		{1, true, 0},
+		{1, false, 40 * time.Millisecond},
+		{2, true, 80 * time.Millisecond},
+		{5, true, 200 * time.Millisecond},
+	}
+	for _, c := range cases {
+		if w := batchWindow(cfg, c.ruleID, c.light); w != c.expect {
+			t.Errorf("bad window of rule %d, light: %v, expected: %s, actual: %s", c.ruleID, c.light, c.expect, w)
+		}
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	config.ReadConfig().Cjsfy.Models = []string{"gemini-1.5-pro"}
+	t.Cleanup(func() {
+		config.ReadConfig().Cjsfy.Models = nil
+	})
+	if opts := newOptions("models/gemini-1.5-pro", nil); opts == nil || opts.Model != "gemini-1.5-pro" {
+		t.Errorf("the listed model should be taken: %+v", opts)
+	}
+	if opts := newOptions("gemini-unknown", nil); opts != nil {
+		t.Errorf("the unlisted model should be ignored: %+v", opts)
+	}
+}
+
+func TestLaneDropsCanceled(t *testing.T) {
+	l := newLane(laneKey{})
+	canceled := make(chan struct{})
+	close(canceled)
+	l.push(&request{text: "a", cancelCh: canceled})
+	l.push(&request{text: "b"})
+	if req := l.pop(); req == nil || req.text != "b" {
+		t.Errorf("the canceled request should be dropped, got %+v", req)
+	}
+	if req := l.pop(); req != nil {
+		t.Errorf("the queue should be empty, got %+v", req)
+	}
+}
@@ -0,0 +1,301 @@
+package cjsfy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+type ChatMessage struct {
+	Role    string      `json:"role,omitempty"`
+	Content ChatContent `json:"content,omitempty"`
+}
+
+// ChatContent is the content of a message, either a string or a list of
+// parts, only the text parts are taken.
+type ChatContent string
+
+func (c *ChatContent) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var parts []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(data, &parts); err != nil {
+			return err
+		}
+		var texts []string
+		for _, p := range parts {
+			if p.Type == "text" {
+				texts = append(texts, p.Text)
+			}
+		}
+		*c = ChatContent(strings.Join(texts, "\n"))
+		return nil
+	}
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s != nil {
+		*c = ChatContent(*s)
+	}
+	return nil
+}
+
+type ChatCompletionRequest struct {
+	Model               string         `json:"model"`
+	Messages            []*ChatMessage `json:"messages"`
+	Stream              bool           `json:"stream"`
+	Temperature         *float32       `json:"temperature,omitempty"`
+	TopP                *float32       `json:"top_p,omitempty"`
+	MaxTokens           *int32         `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int32         `json:"max_completion_tokens,omitempty"`
+}
+
+func (req *ChatCompletionRequest) generation() *config.GenerationConfig {
+	maxTokens := req.MaxCompletionTokens
+	if maxTokens == nil {
+		maxTokens = req.MaxTokens
+	}
+	if req.Temperature == nil && req.TopP == nil && maxTokens == nil {
+		return nil
+	}
+	return &config.GenerationConfig{
+		Temperature:     req.Temperature,
+		TopP:            req.TopP,
+		MaxOutputTokens: maxTokens,
+	}
+}
+
+type ChatCompletionResponse struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []*ChatChoice `json:"choices"`
+}
+
+type ChatChoice struct {
+	Index        int          `json:"index"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	Delta        *ChatMessage `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type ModelList struct {
+	Object string   `json:"object"`
+	Data   []*Model `json:"data"`
+}
+
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// OpenAIError is the error body of the OpenAI API.
+type OpenAIError struct {
+	Error *OpenAIErrorDetail `json:"error"`
+}
+
+type OpenAIErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+func renderOpenAIError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	typ := "server_error"
+	switch code {
+	case http.StatusBadRequest:
+		typ = "invalid_request_error"
+	case http.StatusUnauthorized, http.StatusForbidden:
+		typ = "authentication_error"
+	case http.StatusTooManyRequests:
+		typ = "rate_limit_error"
+	}
+	render.Status(r, code)
+	render.JSON(w, r, &OpenAIError{
+		Error: &OpenAIErrorDetail{
+			Message: msg,
+			Type:    typ,
+		},
+	})
+}
+
+// authorizedOpenAI checks the password, which can also be given as the
+// bearer token.
+func authorizedOpenAI(r *http.Request) bool {
+	token := os.Getenv("PASSWORD")
+	if token == "" || authorized(r) {
+		return true
+	}
+	return r.Header.Get("Authorization") == "Bearer "+token
+}
+
+// parseChatRequest takes the last user message. A message in the prompt
+// convention carries its own target language, otherwise the language is given
+// by the "to" query, or found in the system messages.
+func parseChatRequest(req *ChatCompletionRequest, to string) (*translation, error) {
+	var last *ChatMessage
+	for _, m := range req.Messages {
+		if m == nil {
+			continue
+		}
+		switch m.Role {
+		case "user":
+			last = m
+		case "system", "developer":
+			if to == "" {
+				to = targetLanguage(string(m.Content))
+			}
+		}
+	}
+	if last == nil || strings.TrimSpace(string(last.Content)) == "" {
+		return nil, fmt.Errorf("no user message to translate")
+	}
+	return translationOf(string(last.Content), to)
+}
+
+func completionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "chatcmpl-" + hex.EncodeToString(b)
+}
+
+// HandleChatCompletions serves the chat completions API of OpenAI, the last
+// user message is translated through the same merging queue as cjsfy.
+func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if !authorizedOpenAI(r) {
+		renderOpenAIError(w, r, http.StatusUnauthorized, "bad password")
+		return
+	}
+	req := &ChatCompletionRequest{}
+	if err := render.Decode(r, req); err != nil {
+		log.Debugf("bad request: %s", err)
+		renderOpenAIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	t, err := parseChatRequest(req, r.URL.Query().Get("to"))
+	if err != nil {
+		log.Errorf("bad request: %s", err)
+		renderOpenAIError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+	defer cancel()
+
+	cancelCh := make(chan struct{})
+	defer close(cancelCh)
+	requests, err := submit(ctx, []*translation{t}, newOptions(req.Model, req.generation()), cancelCh, req.Stream)
+	if err != nil {
+		renderOpenAIError(w, r, http.StatusGatewayTimeout, err.Error())
+		return
+	}
+	transReq := requests[0]
+	resp := &ChatCompletionResponse{
+		ID:      completionID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+	stop := "stop"
+
+	if req.Stream {
+		resp.Object = "chat.completion.chunk"
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		write := func(v any) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				log.Errorf("failed to marshal stream response: %s", err)
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		role := "assistant"
+		err := streamRequest(ctx, transReq, func(text string, finishReason string) {
+			resp.Choices = []*ChatChoice{{Delta: &ChatMessage{Role: role, Content: ChatContent(text)}}}
+			role = ""
+			write(resp)
+		})
+		if err != nil {
+			log.Errorf("chat completions stream error: %s", err)
+			write(&OpenAIError{Error: &OpenAIErrorDetail{Message: err.Error(), Type: "server_error"}})
+			return
+		}
+		resp.Choices = []*ChatChoice{{Delta: &ChatMessage{}, FinishReason: &stop}}
+		write(resp)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		return
+	}
+
+	select {
+	case result := <-transReq.respCh:
+		if result.err != nil {
+			renderOpenAIError(w, r, errorCode(result.err), result.err.Error())
+			return
+		}
+		resp.Choices = []*ChatChoice{
+			{
+				Message: &ChatMessage{
+					Role:    "assistant",
+					Content: ChatContent(result.translatedText),
+				},
+				FinishReason: &stop,
+			},
+		}
+		render.JSON(w, r, resp)
+	case <-ctx.Done():
+		renderOpenAIError(w, r, http.StatusGatewayTimeout, ctx.Err().Error())
+	}
+}
+
+// HandleModels lists the models of the "cjsfy.models" config, or the model
+// in use if it's empty.
+func HandleModels(w http.ResponseWriter, r *http.Request) {
+	if !authorizedOpenAI(r) {
+		renderOpenAIError(w, r, http.StatusUnauthorized, "bad password")
+		return
+	}
+	cfg := config.ReadConfig()
+	names := cfg.Cjsfy.Models
+	if len(names) == 0 {
+		name := cfg.ModelName
+		if name == "" {
+			name = os.Getenv("MODEL_NAME")
+		}
+		if name == "" {
+			name = "gemini-pro"
+		}
+		names = []string{name}
+	}
+	list := &ModelList{Object: "list"}
+	for _, name := range names {
+		list.Data = append(list.Data, &Model{
+			ID:      name,
+			Object:  "model",
+			OwnedBy: "hcfy-gemini",
+		})
+	}
+	render.JSON(w, r, list)
+}
@@ -0,0 +1,29 @@
+package cjsfy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseChatRequest(t *testing.T) {
+	req := &ChatCompletionRequest{}
+	body := `{"model":"m","messages":[
+		{"role":"system","content":"You translate the text into Japanese."},
+		{"role":"user","content":[{"type":"text","text":"hello"},{"type":"image_url"}]}
+	]}`
+	if err := json.Unmarshal([]byte(body), req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tr, err := parseChatRequest(req, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tr.to != "日语" || tr.text != "hello" {
+		t.Errorf("bad translation: %+v", tr)
+	}
+
+	req.Messages = req.Messages[1:]
+	if _, err := parseChatRequest(req, ""); err == nil {
+		t.Errorf("expect an error without the target language")
+	}
+}
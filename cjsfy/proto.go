@@ -1,22 +1,67 @@
 package cjsfy
 
+import "github.com/zjx20/hcfy-gemini/config"
+
 type Content struct {
-	Role  string  `json:"role"`
+	Role  string  `json:"role,omitempty"`
 	Parts []*Part `json:"parts"`
 }
 
+// Part is a part of the content, only the text parts are translated.
 type Part struct {
 	Text string `json:"text"`
 }
 
 type GeminiAPIRequest struct {
-	Contents []*Content `json:"contents"`
+	Contents          []*Content        `json:"contents"`
+	SystemInstruction *Content          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *GenerationConfig `json:"generationConfig,omitempty"`
+}
+
+// GenerationConfig is the generation parameters of the Gemini API.
+type GenerationConfig struct {
+	Temperature     *float32 `json:"temperature,omitempty"`
+	TopP            *float32 `json:"topP,omitempty"`
+	TopK            *int32   `json:"topK,omitempty"`
+	CandidateCount  *int32   `json:"candidateCount,omitempty"`
+	MaxOutputTokens *int32   `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+// toConfig converts the parameters to override the cjsfy endpoint. Only the
+// sampling parameters are taken, the candidate count and the stop sequences
+// would break the output of the translation prompt.
+func (c *GenerationConfig) toConfig() *config.GenerationConfig {
+	if c == nil || (c.Temperature == nil && c.TopP == nil && c.TopK == nil && c.MaxOutputTokens == nil) {
+		return nil
+	}
+	return &config.GenerationConfig{
+		Temperature:     c.Temperature,
+		TopP:            c.TopP,
+		TopK:            c.TopK,
+		MaxOutputTokens: c.MaxOutputTokens,
+	}
 }
 
 type GeminiAPIResponse struct {
-	Candidates []*Candidate `json:"candidates"`
+	Candidates   []*Candidate `json:"candidates"`
+	ModelVersion string       `json:"modelVersion,omitempty"`
 }
 
 type Candidate struct {
-	Content *Content `json:"content"`
+	Content      *Content `json:"content"`
+	FinishReason string   `json:"finishReason,omitempty"`
+	Index        int      `json:"index"`
+}
+
+// ErrorResponse is the error body of the Gemini API.
+type ErrorResponse struct {
+	Error *Status `json:"error"`
+}
+
+// Status is a google.rpc.Status.
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
 }
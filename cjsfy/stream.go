@@ -0,0 +1,167 @@
+package cjsfy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// streamWriter writes the streamed responses of the Gemini API, in SSE if the
+// request has "alt=sse", or as the elements of a JSON array otherwise.
+type streamWriter struct {
+	w   http.ResponseWriter
+	sse bool
+	n   int
+}
+
+func newStreamWriter(w http.ResponseWriter, r *http.Request) *streamWriter {
+	sse := r.URL.Query().Get("alt") == "sse"
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return &streamWriter{w: w, sse: sse}
+}
+
+func (s *streamWriter) write(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("failed to marshal stream response: %s", err)
+		return
+	}
+	switch {
+	case s.sse:
+		fmt.Fprintf(s.w, "data: %s\r\n\r\n", data)
+	case s.n == 0:
+		fmt.Fprintf(s.w, "[%s", data)
+	default:
+		fmt.Fprintf(s.w, ",\r\n%s", data)
+	}
+	s.n++
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close ends the JSON array.
+func (s *streamWriter) close() {
+	if s.sse {
+		return
+	}
+	if s.n == 0 {
+		fmt.Fprint(s.w, "[")
+	}
+	fmt.Fprint(s.w, "]")
+}
+
+// HandleStream serves the streamGenerateContent method of the Gemini API. The
+// translated segments of every text part are written in order as soon as
+// they are parsed from the output of the model, even if the part is merged
+// with others. The concatenation of the chunks is the same as the text
+// answered by Handle.
+func HandleStream(w http.ResponseWriter, r *http.Request) {
+	translations, opts, ok := decodeRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+	defer cancel()
+
+	cancelCh := make(chan struct{})
+	defer close(cancelCh)
+	requests, err := submit(ctx, translations, opts, cancelCh, true)
+	if err != nil {
+		renderError(w, r, http.StatusGatewayTimeout, err.Error())
+		return
+	}
+
+	model := chi.URLParam(r, "model")
+	sw := newStreamWriter(w, r)
+	defer sw.close()
+	chunk := func(text string, finishReason string) {
+		sw.write(&GeminiAPIResponse{
+			Candidates: []*Candidate{
+				{
+					Content: &Content{
+						Role:  "model",
+						Parts: []*Part{{Text: text}},
+					},
+					FinishReason: finishReason,
+				},
+			},
+			ModelVersion: model,
+		})
+	}
+	fail := func(code int, err error) {
+		log.Errorf("cjsfy stream error: %s", err)
+		sw.write(&ErrorResponse{
+			Error: &Status{
+				Code:    code,
+				Message: err.Error(),
+				Status:  statusNames[code],
+			},
+		})
+	}
+	for _, transReq := range requests {
+		if err := streamRequest(ctx, transReq, chunk); err != nil {
+			if ctx.Err() != nil {
+				fail(http.StatusGatewayTimeout, ctx.Err())
+			} else {
+				fail(errorCode(err), err)
+			}
+			return
+		}
+	}
+	chunk("", "STOP")
+}
+
+// streamRequest writes the segments of the request in order, the segments
+// parsed out of order are held until the ones before them are written.
+func streamRequest(ctx context.Context, req *request, chunk func(text string, finishReason string)) error {
+	next := 0
+	pending := map[int]string{}
+	emit := func(idx int, text string) {
+		pending[idx] = text
+		for {
+			text, ok := pending[next]
+			if !ok {
+				return
+			}
+			delete(pending, next)
+			if next > 0 {
+				text = "\n" + keepSymbol + "\n" + text
+			}
+			chunk(text, "")
+			next++
+		}
+	}
+	for {
+		select {
+		case p := <-req.paraCh:
+			emit(p.Index, p.Text)
+		case result := <-req.respCh:
+			for len(req.paraCh) > 0 {
+				p := <-req.paraCh
+				emit(p.Index, p.Text)
+			}
+			if result.err != nil {
+				return result.err
+			}
+			// the model may not support streaming, write the rest
+			for next < len(result.segments) {
+				emit(next, result.segments[next])
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
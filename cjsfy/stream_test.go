@@ -0,0 +1,36 @@
+package cjsfy
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/translate"
+)
+
+func TestStreamRequest(t *testing.T) {
+	req := &request{
+		text:   "a" + keepSymbol + "b" + keepSymbol + "c",
+		respCh: make(chan *response, 1),
+		paraCh: make(chan *translate.Paragraph, 3),
+	}
+	req.paraCh <- &translate.Paragraph{Index: 1, Text: "B"}
+	req.paraCh <- &translate.Paragraph{Index: 0, Text: "A"}
+	req.respCh <- &response{segments: []string{"A", "B", "C"}}
+
+	var chunks []string
+	err := streamRequest(context.Background(), req, func(text string, finishReason string) {
+		chunks = append(chunks, text)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sep := "\n" + keepSymbol + "\n"
+	if expect := []string{"A", sep + "B", sep + "C"}; !reflect.DeepEqual(chunks, expect) {
+		t.Errorf("bad chunks, expected: %q, actual: %q", expect, chunks)
+	}
+	if joined := strings.Join(chunks, ""); joined != "A"+sep+"B"+sep+"C" {
+		t.Errorf("the chunks should make up the whole text: %q", joined)
+	}
+}
@@ -21,13 +21,166 @@ var (
 )
 
 type Config struct {
-	APIKey    string `json:"api_key"`
-	ModelName string `json:"model_name"`
+	APIKey string `json:"api_key"`
+	// 多个 API key，会和 api_key 合并使用
+	APIKeys []string `json:"api_keys"`
+	// 每个 API key 每分钟的请求数上限，为 0 时使用默认值 60
+	RPMPerKey int `json:"rpm_per_key"`
+	// API key 被限流或拒绝后暂停使用的秒数，为 0 时使用默认值 60
+	KeyCooldown int `json:"key_cooldown"`
+	// API key 的选择策略，round-robin 或 least-loaded
+	KeySelection string `json:"key_selection"`
+	ModelName    string `json:"model_name"`
+	// 翻译后端，为空时使用 gemini
+	Backend string `json:"backend"`
+	// 翻译结果的输出格式，marker（默认）或 json，模型不支持 json 时自动使用 marker
+	OutputMode string `json:"output_mode"`
+	// 自定义提示词模板文件，key 为模板名（single_dest、multi_dest 或 lookup），value 为文件路径
+	Prompts map[string]string `json:"prompts"`
+	// 提示词模板中可以通过 .Vars 引用的自定义变量
+	PromptVars map[string]string `json:"prompt_vars"`
+	// 翻译失败时的重试策略
+	Retry RetryConfig `json:"retry"`
+	// 翻译结果缺少部分段落时，只重新请求缺少的段落，这里是最多重新请求的轮数，为 0 时使用默认值 2
+	SalvageRetries int `json:"salvage_retries"`
+	// 术语表文件，key 为目标语种，value 为 CSV 或 JSON 文件路径
+	Glossaries map[string]string `json:"glossaries"`
+	// 翻译结果不符合术语表时的重试次数，为 0 时只记录日志
+	GlossaryRetries int `json:"glossary_retries"`
+	// 生成参数
+	Generation GenerationConfig `json:"generation"`
+	// 按入口覆盖的生成参数，key 为入口名（hcfy 或 cjsfy），未设置的字段使用 generation 的值
+	EndpointGeneration map[string]*GenerationConfig `json:"endpoint_generation"`
+	// 段落级翻译缓存
+	Cache CacheConfig `json:"cache"`
+	// 单词查询模式
+	Lookup LookupConfig `json:"lookup"`
+	// 同时翻译成请求中的所有目标语种，也可以通过请求的 all_destinations 字段开启
+	AllDestinations bool `json:"all_destinations"`
+	// token 估算和模型的输入输出上限
+	Tokens TokensConfig `json:"tokens"`
+	// cjsfy 代理（包括 Gemini 和 OpenAI 兼容接口）的设置
+	Cjsfy CjsfyConfig `json:"cjsfy"`
+	// 自定义 gemini API 地址，为空时使用官方地址
+	Endpoint  string `json:"endpoint"`
 	UserAgent string `json:"user-agent"`
 	Debug     bool   `json:"debug"`
 	LogLevel  string `json:"log-level"`
 }
 
+// GenerationConfig 是模型的生成参数，为空的字段使用模型的默认值
+type GenerationConfig struct {
+	Temperature     *float32 `json:"temperature,omitempty"`
+	TopP            *float32 `json:"top_p,omitempty"`
+	TopK            *int32   `json:"top_k,omitempty"`
+	MaxOutputTokens *int32   `json:"max_output_tokens,omitempty"`
+	CandidateCount  *int32   `json:"candidate_count,omitempty"`
+	StopSequences   []string `json:"stop_sequences,omitempty"`
+	// 安全设置，key 为类别（harassment、hate_speech、sexually_explicit、dangerous_content），
+	// value 为阈值（block_none、block_only_high、block_medium_and_above、block_low_and_above）
+	Safety map[string]string `json:"safety,omitempty"`
+}
+
+// Merge 返回用 override 中已设置的字段覆盖后的生成参数
+func (c GenerationConfig) Merge(override *GenerationConfig) GenerationConfig {
+	if override == nil {
+		return c
+	}
+	if override.Temperature != nil {
+		c.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		c.TopP = override.TopP
+	}
+	if override.TopK != nil {
+		c.TopK = override.TopK
+	}
+	if override.MaxOutputTokens != nil {
+		c.MaxOutputTokens = override.MaxOutputTokens
+	}
+	if override.CandidateCount != nil {
+		c.CandidateCount = override.CandidateCount
+	}
+	if override.StopSequences != nil {
+		c.StopSequences = override.StopSequences
+	}
+	if len(override.Safety) > 0 {
+		safety := make(map[string]string, len(c.Safety)+len(override.Safety))
+		for k, v := range c.Safety {
+			safety[k] = v
+		}
+		for k, v := range override.Safety {
+			safety[k] = v
+		}
+		c.Safety = safety
+	}
+	return c
+}
+
+// GetGenerationConfig 返回某个入口的生成参数
+func GetGenerationConfig(endpoint string) GenerationConfig {
+	return config.Generation.Merge(config.EndpointGeneration[endpoint])
+}
+
+type RetryConfig struct {
+	// 最多尝试的次数（包括第一次），为 0 时使用默认值 5
+	MaxAttempts int `json:"max_attempts"`
+	// 第一次重试前等待的毫秒数，之后每次翻倍，为 0 时使用默认值 500
+	BaseDelay int `json:"base_delay"`
+	// 重试前最多等待的毫秒数，为 0 时使用默认值 30000
+	MaxDelay int `json:"max_delay"`
+	// 每次请求模型的超时时间（秒），超时后按可重试的错误处理，为 0 时不限制
+	AttemptTimeout int `json:"attempt_timeout"`
+}
+
+type CacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// 内存中最多缓存的段落数，为 0 时使用默认值 10000
+	MaxEntries int `json:"max_entries"`
+	// 缓存的有效期（秒），为 0 时使用默认值 7 天
+	TTL int `json:"ttl"`
+	// 磁盘缓存目录，为空时不启用磁盘缓存
+	DiskDir string `json:"disk_dir"`
+	// 磁盘中最多缓存的段落数，为 0 时使用默认值 100000
+	DiskMaxEntries int `json:"disk_max_entries"`
+}
+
+type TokensConfig struct {
+	// 是否调用模型的 CountTokens 接口精确计算提示词的 token 数，并用它校准本地估算
+	CountTokens bool `json:"count_tokens"`
+	// 模型的输入 token 上限，为 0 时使用默认值 30720
+	MaxInputTokens int `json:"max_input_tokens"`
+	// 模型的输出 token 上限，为 0 时使用 generation 中的 max_output_tokens，都没有设置时使用默认值 8192
+	MaxOutputTokens int `json:"max_output_tokens"`
+}
+
+type CjsfyConfig struct {
+	// 从用户消息中提取目标语种和原文的格式，{{to}} 是目标语种，{{text}} 是原文，
+	// 为空时使用 "{{to}}\n-----splitter-----\n{{text}}"
+	Prompt string `json:"prompt"`
+	// OpenAI 兼容接口 /v1/models 列出的模型，为空时只列出 model_name
+	Models []string `json:"models"`
+	// 合并请求时最多等待的毫秒数，为 0 时使用默认值 300
+	MaxWait int `json:"max_wait"`
+	// 请求数达到这个值并且没有更多排队的请求时立即发送，不再等待，为 0 时总是等待 max_wait
+	MinBatch int `json:"min_batch"`
+	// 每批最多的请求数，为 0 时不限制
+	MaxBatch int `json:"max_batch"`
+	// 每批最多的 token 数，key 为令牌桶的消费规则（1 到 5，剩余配额从多到少），未设置的规则使用默认值
+	MergeTokens map[int]int `json:"merge_tokens"`
+	// 根据配额自适应调整等待时间：配额充足且没有其他排队的请求时立即发送，配额越紧张等待越久
+	Adaptive bool `json:"adaptive"`
+}
+
+type LookupConfig struct {
+	// 划词翻译的内容是单词或短语时，返回音标、词性、释义和例句
+	Enabled bool `json:"enabled"`
+	// 最多的单词数，中日韩文字每两个字算一个单词，为 0 时使用默认值 3
+	MaxWords int `json:"max_words"`
+	// 最多的字符数，为 0 时使用默认值 40
+	MaxChars int `json:"max_chars"`
+}
+
 func Init() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -105,6 +258,52 @@ func GetIsDebug() bool {
 	return config.Debug
 }
 
+// GetAPIKeys 返回所有可用的 API key，环境变量 GEMINI_API_KEY 可以用逗号分隔多个 key
+func GetAPIKeys() []string {
+	var keys []string
+	seen := map[string]bool{}
+	add := func(k string) {
+		k = strings.TrimSpace(k)
+		if k != "" && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	add(config.APIKey)
+	for _, k := range config.APIKeys {
+		add(k)
+	}
+	if len(keys) == 0 {
+		for _, k := range strings.Split(os.Getenv("GEMINI_API_KEY"), ",") {
+			add(k)
+		}
+	}
+	return keys
+}
+
+func GetRPMPerKey() int {
+	if config.RPMPerKey > 0 {
+		return config.RPMPerKey
+	}
+	return 60
+}
+
+// GetTotalRPM 返回所有 API key 加起来每分钟的请求数上限
+func GetTotalRPM() int {
+	n := len(GetAPIKeys())
+	if n == 0 {
+		n = 1
+	}
+	return n * GetRPMPerKey()
+}
+
+func GetKeyCooldown() time.Duration {
+	if config.KeyCooldown > 0 {
+		return time.Duration(config.KeyCooldown) * time.Second
+	}
+	return 60 * time.Second
+}
+
 func GetLogLevel() logrus.Level {
 	switch strings.ToLower(config.LogLevel) {
 	case "debug":
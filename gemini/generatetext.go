@@ -3,50 +3,142 @@ package gemini
 import (
 	"context"
 	"fmt"
-	"log"
-	"time"
 
 	"github.com/google/generative-ai-go/genai"
-	"github.com/zjx20/hcfy-gemini/util/httpclient"
-	"google.golang.org/api/option"
-	"google.golang.org/api/transport/http"
+	"google.golang.org/api/iterator"
 )
 
 type GenerateTextConfig struct {
 	APIKey    string
 	ModelName string // empty for "gemini-pro"
+	Endpoint  string // empty for the default endpoint
 	Prompt    string
+	// ResponseSchema asks for a JSON output of the schema if not nil
+	ResponseSchema *genai.Schema
+	// Generation overrides the default generation parameters
+	Generation     genai.GenerationConfig
+	SafetySettings []*genai.SafetySetting
 }
 
-func GenerateText(ctx context.Context, cfg GenerateTextConfig) (string, error) {
-	c := httpclient.CustomPingInterval(15 * time.Second)
-	apiTrans, err := http.NewTransport(ctx, c.Transport, option.WithAPIKey(cfg.APIKey))
+type GenerateTextResult struct {
+	Text         string
+	PromptTokens int
+	OutputTokens int
+	TotalTokens  int
+	// FinishReason is why the model stopped, e.g. genai.FinishReasonMaxTokens
+	// if the output is truncated
+	FinishReason  genai.FinishReason
+	SafetyRatings []*genai.SafetyRating
+}
+
+func GenerateText(ctx context.Context, cfg GenerateTextConfig) (*GenerateTextResult, error) {
+	// For text-only input, use the gemini-pro model
+	modelName := cfg.ModelName
+	if modelName == "" {
+		modelName = "gemini-pro"
+	}
+	c, err := pool.acquire(poolKey{
+		apiKey:    cfg.APIKey,
+		modelName: modelName,
+		endpoint:  cfg.Endpoint,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create API transport: %w", err)
+		return nil, err
 	}
-	c.Transport = apiTrans
+	defer pool.release(c)
 
-	client, err := genai.NewClient(ctx, option.WithHTTPClient(c), option.WithAPIKey(cfg.APIKey))
+	model := newModel(c, &cfg)
+	resp, err := model.GenerateContent(ctx, genai.Text(cfg.Prompt))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to generate text: %w", err)
 	}
-	defer client.Close()
+	return toResult(resp)
+}
 
-	// For text-only input, use the gemini-pro model
+// GenerateTextStream is like GenerateText, but calls onChunk with every piece
+// of text as soon as it arrives.
+func GenerateTextStream(ctx context.Context, cfg GenerateTextConfig, onChunk func(text string)) (*GenerateTextResult, error) {
 	modelName := cfg.ModelName
 	if modelName == "" {
 		modelName = "gemini-pro"
 	}
-	model := client.GenerativeModel(modelName)
-	resp, err := model.GenerateContent(ctx, genai.Text(cfg.Prompt))
+	c, err := pool.acquire(poolKey{
+		apiKey:    cfg.APIKey,
+		modelName: modelName,
+		endpoint:  cfg.Endpoint,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to generate text: %w", err)
+		return nil, err
 	}
+	defer pool.release(c)
+
+	model := newModel(c, &cfg)
+	iter := model.GenerateContentStream(ctx, genai.Text(cfg.Prompt))
+	text := ""
+	var last *genai.GenerateContentResponse
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate text: %w", err)
+		}
+		// the last chunk may carry nothing but the finish reason
+		if chunk, err := toResult(resp); err == nil && chunk.Text != "" {
+			text += chunk.Text
+			onChunk(chunk.Text)
+		}
+		last = resp
+	}
+	if last == nil {
+		return nil, fmt.Errorf("no candidate in response")
+	}
+	res := &GenerateTextResult{Text: text}
+	setUsage(res, last)
+	return res, nil
+}
+
+// CountTokens counts the tokens of the prompt with the model.
+func CountTokens(ctx context.Context, cfg GenerateTextConfig) (int, error) {
+	modelName := cfg.ModelName
+	if modelName == "" {
+		modelName = "gemini-pro"
+	}
+	c, err := pool.acquire(poolKey{
+		apiKey:    cfg.APIKey,
+		modelName: modelName,
+		endpoint:  cfg.Endpoint,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer pool.release(c)
+
+	resp, err := newModel(c, &cfg).CountTokens(ctx, genai.Text(cfg.Prompt))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count tokens: %w", err)
+	}
+	return int(resp.TotalTokens), nil
+}
+
+func newModel(c *pooledClient, cfg *GenerateTextConfig) *genai.GenerativeModel {
+	model := *c.model
+	model.GenerationConfig = cfg.Generation
+	model.SafetySettings = cfg.SafetySettings
+	if cfg.ResponseSchema != nil {
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = cfg.ResponseSchema
+	}
+	return &model
+}
+
+func toResult(resp *genai.GenerateContentResponse) (*GenerateTextResult, error) {
 	if len(resp.Candidates) == 0 {
-		return "", fmt.Errorf("no candidate in response")
+		return nil, fmt.Errorf("no candidate in response")
 	}
 	if resp.Candidates[0].Content == nil {
-		return "", fmt.Errorf("no content in the first candidate")
+		return nil, fmt.Errorf("no content in the first candidate")
 	}
 	result := ""
 	for _, part := range resp.Candidates[0].Content.Parts {
@@ -59,5 +151,20 @@ func GenerateText(ctx context.Context, cfg GenerateTextConfig) (string, error) {
 			result += fmt.Sprintf("<unknown part type %T, value: %+v>", p, p)
 		}
 	}
-	return result, nil
+	res := &GenerateTextResult{Text: result}
+	setUsage(res, resp)
+	return res, nil
+}
+
+// setUsage sets the token usage and the finish state of the first candidate.
+func setUsage(res *GenerateTextResult, resp *genai.GenerateContentResponse) {
+	if u := resp.UsageMetadata; u != nil {
+		res.PromptTokens = int(u.PromptTokenCount)
+		res.OutputTokens = int(u.CandidatesTokenCount)
+		res.TotalTokens = int(u.TotalTokenCount)
+	}
+	if len(resp.Candidates) > 0 {
+		res.FinishReason = resp.Candidates[0].FinishReason
+		res.SafetyRatings = resp.Candidates[0].SafetyRatings
+	}
 }
@@ -0,0 +1,217 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	SelectRoundRobin  = "round-robin"
+	SelectLeastLoaded = "least-loaded"
+)
+
+type keyState struct {
+	key           string
+	inflight      int
+	recent        []time.Time // request timestamps within the last minute
+	cooldownUntil time.Time
+}
+
+// KeysExhaustedError is returned by Acquire if every key is cooling down or
+// out of quota. RetryAfter is when the first of them recovers.
+type KeysExhaustedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *KeysExhaustedError) Error() string {
+	return fmt.Sprintf("all API keys are cooling down or out of quota, retry after %s", e.RetryAfter)
+}
+
+func (k *keyState) prune(now time.Time) {
+	i := 0
+	for i < len(k.recent) && now.Sub(k.recent[i]) >= time.Minute {
+		i++
+	}
+	k.recent = k.recent[i:]
+}
+
+// availableAt is when the key can be used again, with the quota of rpm
+// requests per minute.
+func (k *keyState) availableAt(rpm int) time.Time {
+	at := k.cooldownUntil
+	if rpm > 0 && len(k.recent) >= rpm {
+		if quota := k.recent[len(k.recent)-rpm].Add(time.Minute); quota.After(at) {
+			at = quota
+		}
+	}
+	return at
+}
+
+// KeyRing spreads requests across multiple API keys. Every key has its own
+// per-minute quota, and a key that is rejected by the server is taken out of
+// rotation for a cool-down period.
+type KeyRing struct {
+	mu        sync.Mutex
+	keys      []*keyState
+	next      int
+	rpm       int
+	cooldown  time.Duration
+	selection string
+}
+
+func NewKeyRing(keys []string, rpm int, cooldown time.Duration, selection string) *KeyRing {
+	r := &KeyRing{
+		rpm:       rpm,
+		cooldown:  cooldown,
+		selection: selection,
+	}
+	for _, k := range keys {
+		r.keys = append(r.keys, &keyState{key: k})
+	}
+	return r
+}
+
+// Update applies a new config to the ring. The states of the keys that are
+// still in use, i.e. the cool-downs and the recent requests, are kept.
+func (r *KeyRing) Update(keys []string, rpm int, cooldown time.Duration, selection string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := make(map[string]*keyState, len(r.keys))
+	for _, k := range r.keys {
+		old[k.key] = k
+	}
+	states := make([]*keyState, 0, len(keys))
+	for _, key := range keys {
+		k, ok := old[key]
+		if !ok {
+			k = &keyState{key: key}
+		}
+		states = append(states, k)
+	}
+	r.keys = states
+	if r.next > len(states) {
+		r.next = 0
+	}
+	r.rpm = rpm
+	r.cooldown = cooldown
+	r.selection = selection
+}
+
+func (r *KeyRing) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.keys)
+}
+
+// Acquire picks a key for the next request, skipping the keys in exclude.
+// The caller must call Release with the returned key after the request. If
+// every key is cooling down or out of quota, a *KeysExhaustedError is
+// returned rather than overusing a key.
+func (r *KeyRing) Acquire(exclude map[string]bool) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var candidates []int
+	for i, k := range r.keys {
+		k.prune(now)
+		if exclude[k.key] || now.Before(k.cooldownUntil) {
+			continue
+		}
+		if r.rpm > 0 && len(k.recent) >= r.rpm {
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		var first time.Time
+		for _, k := range r.keys {
+			if exclude[k.key] {
+				continue
+			}
+			if at := k.availableAt(r.rpm); first.IsZero() || at.Before(first) {
+				first = at
+			}
+		}
+		if first.IsZero() {
+			return "", fmt.Errorf("no API key available")
+		}
+		return "", &KeysExhaustedError{RetryAfter: first.Sub(now)}
+	}
+	var picked *keyState
+	if r.selection == SelectLeastLoaded {
+		for _, i := range candidates {
+			k := r.keys[i]
+			if picked == nil || k.inflight+len(k.recent) < picked.inflight+len(picked.recent) {
+				picked = k
+			}
+		}
+	} else {
+		idx := candidates[0]
+		for _, i := range candidates {
+			if i >= r.next {
+				idx = i
+				break
+			}
+		}
+		r.next = idx + 1
+		picked = r.keys[idx]
+	}
+	return r.use(picked, now), nil
+}
+
+func (r *KeyRing) use(k *keyState, now time.Time) string {
+	k.inflight++
+	k.recent = append(k.recent, now)
+	return k.key
+}
+
+// Release reports the result of a request made with the key. It returns true
+// if the key has been put into cool-down because of err.
+func (r *KeyRing) Release(key string, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		if k.key != key {
+			continue
+		}
+		k.inflight--
+		if isKeyRejected(err) {
+			k.cooldownUntil = time.Now().Add(r.cooldown)
+			log.Warnf("API key %s is cooling down for %s, err: %s", maskKey(key), r.cooldown, err)
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// isKeyRejected reports whether err means that the key itself can't be used
+// for now, e.g. it's rate limited or doesn't have the permission.
+func isKeyRejected(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return false
+	}
+	switch gerr.Code {
+	case http.StatusTooManyRequests, http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	case http.StatusBadRequest:
+		return strings.Contains(gerr.Message, "API key") ||
+			strings.Contains(gerr.Body, "API_KEY_INVALID")
+	}
+	return false
+}
+
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return "***"
+	}
+	return key[:4] + "***" + key[len(key)-4:]
+}
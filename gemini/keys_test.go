@@ -0,0 +1,91 @@
+package gemini
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	r := NewKeyRing([]string{"a", "b", "c"}, 60, time.Minute, SelectRoundRobin)
+	var picked []string
+	for i := 0; i < 4; i++ {
+		key, err := r.Acquire(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		r.Release(key, nil)
+		picked = append(picked, key)
+	}
+	expect := []string{"a", "b", "c", "a"}
+	for i := range expect {
+		if picked[i] != expect[i] {
+			t.Fatalf("bad rotation, expected: %v, actual: %v", expect, picked)
+		}
+	}
+}
+
+func TestKeyRingCooldown(t *testing.T) {
+	r := NewKeyRing([]string{"a", "b"}, 60, time.Minute, SelectLeastLoaded)
+	key, _ := r.Acquire(nil)
+	if !r.Release(key, &googleapi.Error{Code: http.StatusTooManyRequests}) {
+		t.Fatalf("key %s should be cooling down", key)
+	}
+	for i := 0; i < 3; i++ {
+		other, _ := r.Acquire(nil)
+		r.Release(other, nil)
+		if other == key {
+			t.Errorf("key %s is still in rotation", key)
+		}
+	}
+	if _, err := r.Acquire(map[string]bool{"a": true, "b": true}); err == nil {
+		t.Errorf("expect error when all keys are excluded")
+	}
+	other := "a"
+	if key == "a" {
+		other = "b"
+	}
+	r.Release(other, &googleapi.Error{Code: http.StatusTooManyRequests})
+	_, err := r.Acquire(nil)
+	var exhausted *KeysExhaustedError
+	if !errors.As(err, &exhausted) || exhausted.RetryAfter <= 0 || exhausted.RetryAfter > time.Minute {
+		t.Errorf("expect the keys to be exhausted, err: %v", err)
+	}
+}
+
+func TestKeyRingQuota(t *testing.T) {
+	r := NewKeyRing([]string{"a"}, 2, time.Minute, SelectRoundRobin)
+	for i := 0; i < 2; i++ {
+		key, err := r.Acquire(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		r.Release(key, nil)
+	}
+	_, err := r.Acquire(nil)
+	var exhausted *KeysExhaustedError
+	if !errors.As(err, &exhausted) || exhausted.RetryAfter <= 0 || exhausted.RetryAfter > time.Minute {
+		t.Errorf("the key out of quota should not be used, err: %v", err)
+	}
+}
+
+func TestKeyRingUpdate(t *testing.T) {
+	r := NewKeyRing([]string{"a", "b"}, 60, time.Minute, SelectRoundRobin)
+	key, _ := r.Acquire(nil)
+	r.Release(key, &googleapi.Error{Code: http.StatusTooManyRequests})
+
+	r.Update([]string{"a", "b", "c"}, 30, time.Minute, SelectRoundRobin)
+	if r.Len() != 3 {
+		t.Fatalf("bad number of keys, expected: 3, actual: %d", r.Len())
+	}
+	for i := 0; i < 4; i++ {
+		other, _ := r.Acquire(nil)
+		r.Release(other, nil)
+		if other == key {
+			t.Errorf("key %s should still be cooling down after the update", key)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+	"github.com/zjx20/hcfy-gemini/util/httpclient"
+	"google.golang.org/api/option"
+	apihttp "google.golang.org/api/transport/http"
+)
+
+type poolKey struct {
+	apiKey    string
+	modelName string
+	endpoint  string
+}
+
+// pooledClient is a long-lived genai client. It's reference counted so that
+// a client retired by a config change is only closed after the in-flight
+// requests using it have finished.
+type pooledClient struct {
+	client  *genai.Client
+	model   *genai.GenerativeModel
+	refs    int
+	retired bool
+}
+
+type clientPool struct {
+	mu      sync.Mutex
+	clients map[poolKey]*pooledClient
+	// gen is increased by every reset
+	gen int
+}
+
+var pool = &clientPool{
+	clients: make(map[poolKey]*pooledClient),
+}
+
+var stats struct {
+	clientsCreated atomic.Int64
+	requests       atomic.Int64
+	newConns       atomic.Int64
+	reusedConns    atomic.Int64
+}
+
+func init() {
+	config.AddConfigChangeCallback(pool.reset)
+}
+
+// PoolStats is a snapshot of the client pool and its connection reuse.
+type PoolStats struct {
+	Clients        int   `json:"clients"`
+	ClientsCreated int64 `json:"clients_created"`
+	Requests       int64 `json:"requests"`
+	NewConns       int64 `json:"new_conns"`
+	ReusedConns    int64 `json:"reused_conns"`
+}
+
+func GetPoolStats() PoolStats {
+	pool.mu.Lock()
+	n := len(pool.clients)
+	pool.mu.Unlock()
+	return PoolStats{
+		Clients:        n,
+		ClientsCreated: stats.clientsCreated.Load(),
+		Requests:       stats.requests.Load(),
+		NewConns:       stats.newConns.Load(),
+		ReusedConns:    stats.reusedConns.Load(),
+	}
+}
+
+func (p *clientPool) acquire(key poolKey) (*pooledClient, error) {
+	p.mu.Lock()
+	if c, ok := p.clients[key]; ok {
+		c.refs++
+		p.mu.Unlock()
+		return c, nil
+	}
+	gen := p.gen
+	p.mu.Unlock()
+
+	// creating a client may be slow, don't block the others
+	c, err := newPooledClient(key)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.clients[key]; ok {
+		// created by another request in the meantime
+		c.client.Close()
+		existing.refs++
+		return existing, nil
+	}
+	c.refs++
+	if gen != p.gen {
+		// the config has changed during the creation, use it only once
+		c.retired = true
+		return c, nil
+	}
+	p.clients[key] = c
+	return c, nil
+}
+
+func (p *clientPool) release(c *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.refs--
+	if c.retired && c.refs == 0 {
+		c.client.Close()
+	}
+}
+
+// reset retires all the clients, new requests will create fresh ones with
+// the latest config.
+func (p *clientPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gen++
+	for key, c := range p.clients {
+		c.retired = true
+		if c.refs == 0 {
+			c.client.Close()
+		}
+		delete(p.clients, key)
+	}
+}
+
+func newPooledClient(key poolKey) (*pooledClient, error) {
+	ctx := context.Background()
+	c := httpclient.CustomPingInterval(15 * time.Second)
+	apiTrans, err := apihttp.NewTransport(ctx, &statsTransport{c.Transport}, option.WithAPIKey(key.apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API transport: %w", err)
+	}
+	c.Transport = apiTrans
+
+	opts := []option.ClientOption{option.WithHTTPClient(c), option.WithAPIKey(key.apiKey)}
+	if key.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(key.endpoint))
+	}
+	client, err := genai.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create genai client: %w", err)
+	}
+	stats.clientsCreated.Add(1)
+	log.Debugf("created genai client for model %s, endpoint %q", key.modelName, key.endpoint)
+	return &pooledClient{
+		client: client,
+		model:  client.GenerativeModel(key.modelName),
+	}, nil
+}
+
+// statsTransport records whether the underlying connection of each request
+// is a new one or a reused one.
+type statsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	stats.requests.Add(1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				stats.reusedConns.Add(1)
+			} else {
+				stats.newConns.Add(1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.base.RoundTrip(req)
+}
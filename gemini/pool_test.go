@@ -0,0 +1,74 @@
+package gemini
+
+import "testing"
+
+func TestClientPoolRefs(t *testing.T) {
+	p := &clientPool{clients: make(map[poolKey]*pooledClient)}
+	key := poolKey{apiKey: "test", modelName: "gemini-pro"}
+	a, err := p.acquire(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := p.acquire(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if a != b {
+		t.Fatalf("expected the same client for the same key")
+	}
+	if a.refs != 2 {
+		t.Errorf("bad refs, expected: 2, actual: %d", a.refs)
+	}
+	p.release(b)
+	if a.refs != 1 || a.retired {
+		t.Errorf("bad state after release, refs: %d, retired: %v", a.refs, a.retired)
+	}
+
+	p.reset()
+	if len(p.clients) != 0 {
+		t.Errorf("expected no clients after reset, actual: %d", len(p.clients))
+	}
+	if !a.retired {
+		t.Errorf("expected the client retired by reset")
+	}
+	c, err := p.acquire(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c == a {
+		t.Errorf("expected a fresh client after reset")
+	}
+	p.release(a)
+	if a.refs != 0 {
+		t.Errorf("bad refs of the retired client, expected: 0, actual: %d", a.refs)
+	}
+	p.release(c)
+}
+
+func TestClientPoolConcurrentAcquire(t *testing.T) {
+	p := &clientPool{clients: make(map[poolKey]*pooledClient)}
+	key := poolKey{apiKey: "test", modelName: "gemini-pro"}
+	results := make(chan *pooledClient, 8)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			c, err := p.acquire(key)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			results <- c
+		}()
+	}
+	var first *pooledClient
+	for i := 0; i < cap(results); i++ {
+		c := <-results
+		if first == nil {
+			first = c
+		}
+		if c != first {
+			t.Fatalf("expected a single client for the same key")
+		}
+	}
+	if first.refs != cap(results) {
+		t.Errorf("bad refs, expected: %d, actual: %d", cap(results), first.refs)
+	}
+}
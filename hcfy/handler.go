@@ -7,47 +7,13 @@ import (
 	"os"
 	"slices"
 	"strings"
-	"time"
 
 	"github.com/go-chi/render"
 	log "github.com/sirupsen/logrus"
 	"github.com/zjx20/hcfy-gemini/translate"
-	"github.com/zjx20/hcfy-gemini/util/tokenbucket"
 )
 
-var tokenBucket = tokenbucket.NewAdaptiveTokenBucket(60, 60,
-	tokenbucket.ProductionRule{
-		Interval:  1 * time.Minute,
-		Increment: 60,
-	},
-	[]tokenbucket.ConsumptionRule{
-		{
-			RestThreshold: 40,
-			Wait:          0,
-			RuleID:        1,
-		},
-		{
-			RestThreshold: 30,
-			Wait:          100 * time.Millisecond,
-			RuleID:        2,
-		},
-		{
-			RestThreshold: 20,
-			Wait:          500 * time.Millisecond,
-			RuleID:        3,
-		},
-		{
-			RestThreshold: 10,
-			Wait:          2000 * time.Millisecond,
-			RuleID:        4,
-		},
-		{
-			RestThreshold: 0,
-			Wait:          3000 * time.Millisecond,
-			RuleID:        5,
-		},
-	},
-)
+var tokenBucket = translate.NewTokenBucket()
 
 var splitRules = []struct {
 	ruleID   int
@@ -61,12 +27,14 @@ var splitRules = []struct {
 }
 
 type subReq struct {
-	lines     []string
-	index     []int
-	totalChar int
+	lines       []string
+	index       []int
+	totalTokens int
 }
 
-func split(req *translate.TranslateReq, ruleID int) []*subReq {
+// split splits the content of the non-blank segments into sub requests, the
+// index of a sub request refers to the segments.
+func split(segs []*translate.Segment, ruleID int) []*subReq {
 	parts := 1
 	for _, rule := range splitRules {
 		if rule.ruleID == ruleID {
@@ -75,27 +43,29 @@ func split(req *translate.TranslateReq, ruleID int) []*subReq {
 		}
 	}
 	if parts == 1 {
-		lines := strings.Split(req.Text, "\n")
-		index := make([]int, len(lines))
-		for i := range lines {
-			index[i] = i
+		sub := &subReq{}
+		for i, seg := range segs {
+			if !seg.Blank() {
+				sub.lines = append(sub.lines, seg.Content)
+				sub.index = append(sub.index, i)
+			}
 		}
-		return []*subReq{{
-			lines: lines,
-			index: index,
-		}}
+		return []*subReq{sub}
 	}
 	type tmpLine struct {
-		line  string
-		index int
+		line   string
+		index  int
+		tokens int
 	}
 	var lines []*tmpLine
-	for i, line := range strings.Split(req.Text, "\n") {
-		lines = append(lines, &tmpLine{line, i})
+	for i, seg := range segs {
+		if !seg.Blank() {
+			lines = append(lines, &tmpLine{seg.Content, i, translate.EstimateTokens(seg.Content)})
+		}
 	}
-	// sort by length of the line, in reverse order
+	// sort by tokens of the line, in reverse order
 	slices.SortFunc(lines, func(a, b *tmpLine) int {
-		return len(b.line) - len(a.line)
+		return b.tokens - a.tokens
 	})
 
 	// split the request as even as possible
@@ -107,56 +77,125 @@ func split(req *translate.TranslateReq, ruleID int) []*subReq {
 		minTotal := 0
 		picked := -1
 		for i := range res {
-			if picked == -1 || minTotal > res[i].totalChar {
-				minTotal = res[i].totalChar
+			if picked == -1 || minTotal > res[i].totalTokens {
+				minTotal = res[i].totalTokens
 				picked = i
 			}
 		}
 		subReq := res[picked]
 		subReq.lines = append(subReq.lines, l.line)
 		subReq.index = append(subReq.index, l.index)
-		subReq.totalChar += len(l.line)
+		subReq.totalTokens += l.tokens
 	}
 	for i := len(res) - 1; i >= 0; i-- {
-		if res[i].totalChar == 0 {
+		if len(res[i].lines) == 0 {
 			res = res[:i]
 		}
 	}
 	return res
 }
 
-func handleSubReq(ctx context.Context, req *translate.TranslateReq, sub *subReq, needToken bool) *translate.TranslateResult {
-	for {
+// retry runs attempt until it succeeds, retrying the retryable errors with
+// backoff. Every attempt consumes a token, except the first one if needToken
+// is false. what names the operation in the logs.
+func retry(ctx context.Context, what string, needToken bool,
+	attempt func() *translate.TranslateResult) *translate.TranslateResult {
+	for n := 1; ; n++ {
 		if needToken {
-			_, err := tokenBucket.Consume(ctx)
-			if err != nil {
-				return &translate.TranslateResult{
-					Err: err,
-				}
+			if _, err := tokenBucket.Consume(ctx); err != nil {
+				return &translate.TranslateResult{Err: err}
 			}
 		}
 		needToken = true
+		result := attempt()
+		if result.Err == nil || ctx.Err() != nil {
+			return result
+		}
+		delay, ok := translate.RetryDelay(result.Err, n)
+		class, _ := translate.Classify(result.Err)
+		if !ok {
+			log.Errorf("%s error (%s), give up after %d attempts: %s", what, class, n, result.Err)
+			return result
+		}
+		log.Errorf("%s error (%s), retry in %s: %s", what, class, delay, result.Err)
+		if !translate.Sleep(ctx, delay) {
+			return &translate.TranslateResult{Err: ctx.Err()}
+		}
+	}
+}
+
+// handleSubReq translates the sub request, retrying the retryable errors with
+// backoff. If out is not nil, the paragraphs are streamed to it with their
+// original line index. A streamed line is final, it's not sent again by the
+// retries, and the result keeps its text.
+func handleSubReq(ctx context.Context, req *translate.TranslateReq, sub *subReq, needToken bool,
+	out chan<- *translate.Paragraph) *translate.TranslateResult {
+	// sent are the texts of the lines that have been streamed, by the index
+	// in the sub request
+	sent := map[int]string{}
+	return retry(ctx, "translate", needToken, func() *translate.TranslateResult {
 		ch := make(chan *translate.TranslateResult, 1)
 		cloneReq := *req
 		cloneReq.Text = strings.Join(sub.lines, "\n")
-		translate.Translate(&cloneReq, ch)
+		var paraCh chan *translate.Paragraph
+		if out != nil {
+			paraCh = make(chan *translate.Paragraph, len(sub.lines))
+			translate.TranslateStream(ctx, &cloneReq, ch, paraCh)
+		} else {
+			translate.Translate(ctx, &cloneReq, ch)
+		}
+		result := waitResult(ctx, sub, ch, paraCh, out, sent)
+		if result.Err == nil && len(result.Resp.Result) == len(sub.lines) {
+			for idx, text := range sent {
+				result.Resp.Result[idx] = text
+			}
+		}
+		return result
+	})
+}
+
+// lookup looks up the word in the request, retrying the retryable errors
+// with backoff.
+func lookup(ctx context.Context, req *translate.TranslateReq) *translate.TranslateResult {
+	return retry(ctx, "lookup", false, func() *translate.TranslateResult {
+		resp, err := translate.Lookup(ctx, req)
+		return &translate.TranslateResult{Resp: resp, Err: err}
+	})
+}
+
+// waitResult waits for the result of the session, forwarding the streamed
+// paragraphs that haven't been sent to out in the meantime, and recording
+// them in sent.
+func waitResult(ctx context.Context, sub *subReq, ch chan *translate.TranslateResult,
+	paraCh chan *translate.Paragraph, out chan<- *translate.Paragraph, sent map[int]string) *translate.TranslateResult {
+	for {
 		select {
 		case <-ctx.Done():
 			return &translate.TranslateResult{
 				Err: ctx.Err(),
 			}
-		case result := <-ch:
-			if result.Err != nil {
-				log.Errorf("translate error: %s", result.Err)
-				// retry
-			} else {
-				return result
+		case p := <-paraCh:
+			if _, ok := sent[p.Index]; ok {
+				continue
+			}
+			sent[p.Index] = p.Text
+			select {
+			case out <- &translate.Paragraph{Index: sub.index[p.Index], Text: p.Text}:
+			case <-ctx.Done():
+				return &translate.TranslateResult{
+					Err: ctx.Err(),
+				}
 			}
+		case result := <-ch:
+			return result
 		}
 	}
 }
 
-func reconstructResult(req *translate.TranslateReq, subReqs []*subReq, results []*translate.TranslateResult) *translate.TranslateResult {
+// reconstructResult stitches the translated lines back in the layout of the
+// segments, the blank lines are kept as is.
+func reconstructResult(req *translate.TranslateReq, segs []*translate.Segment, subReqs []*subReq,
+	results []*translate.TranslateResult) *translate.TranslateResult {
 	for idx, result := range results {
 		if result.Err != nil {
 			log.Errorf("sub request %d failed, err: %s", idx, result.Err)
@@ -171,21 +210,37 @@ func reconstructResult(req *translate.TranslateReq, subReqs []*subReq, results [
 			}
 		}
 	}
-	totalLines := 0
-	for _, sub := range subReqs {
-		totalLines += len(sub.lines)
-	}
-	lines := make([]string, totalLines)
-	for idx := range subReqs {
-		subReq := subReqs[idx]
-		result := results[idx]
-		for lIdx := range subReq.index {
-			lines[subReq.index[lIdx]] = result.Resp.Result[lIdx]
+	// stitch puts the lines got from every sub result together
+	stitch := func(get func(resp *translate.TranslateResp) []string) []string {
+		lines := make([]string, len(segs))
+		for idx, seg := range segs {
+			if seg.Blank() {
+				lines[idx] = seg.Apply("")
+			}
 		}
+		for idx := range subReqs {
+			subReq := subReqs[idx]
+			result := get(results[idx].Resp)
+			for lIdx, segIdx := range subReq.index {
+				lines[segIdx] = segs[segIdx].Apply(result[lIdx])
+			}
+		}
+		return lines
 	}
 	resp := *results[0].Resp
 	resp.Text = req.Text
-	resp.Result = lines
+	resp.Result = stitch(func(resp *translate.TranslateResp) []string {
+		return resp.Result
+	})
+	resp.Translations = nil
+	for tIdx, t := range results[0].Resp.Translations {
+		resp.Translations = append(resp.Translations, &translate.DestTranslation{
+			To: t.To,
+			Result: stitch(func(resp *translate.TranslateResp) []string {
+				return resp.Translations[tIdx].Result
+			}),
+		})
+	}
 	return &translate.TranslateResult{
 		Resp: &resp,
 	}
@@ -206,8 +261,7 @@ func Handle(w http.ResponseWriter, r *http.Request) {
 		render.PlainText(w, r, err.Error())
 		return
 	}
-	req.Text = strings.TrimSpace(req.Text)
-	if req.Text == "" {
+	if strings.TrimSpace(req.Text) == "" {
 		render.Status(r, http.StatusBadRequest)
 		render.PlainText(w, r, "empty text")
 		return
@@ -219,7 +273,20 @@ func Handle(w http.ResponseWriter, r *http.Request) {
 		render.PlainText(w, r, err.Error())
 		return
 	}
-	subReqs := split(req, ruleID)
+	if translate.IsLookup(req.Text) {
+		result := lookup(r.Context(), req)
+		if result.Err != nil {
+			render.Status(r, http.StatusInternalServerError)
+			render.PlainText(w, r, result.Err.Error())
+			return
+		}
+		render.JSON(w, r, result.Resp)
+		return
+	}
+	// the sub requests should agree on the source, and so the destination
+	translate.SettleSource(req)
+	segs := translate.SplitSegments(req.Text)
+	subReqs := split(segs, ruleID)
 	log.Debugf("request has been splitted into %d sub requests", len(subReqs))
 	results := make([]*translate.TranslateResult, len(subReqs))
 	ch := make(chan struct{}, len(subReqs))
@@ -227,7 +294,7 @@ func Handle(w http.ResponseWriter, r *http.Request) {
 		idx := idx
 		subReq := subReq
 		go func() {
-			result := handleSubReq(r.Context(), req, subReq, idx != 0)
+			result := handleSubReq(r.Context(), req, subReq, idx != 0, nil)
 			results[idx] = result
 			ch <- struct{}{}
 		}()
@@ -245,7 +312,7 @@ func Handle(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	result := reconstructResult(req, subReqs, results)
+	result := reconstructResult(req, segs, subReqs, results)
 	if result.Err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.PlainText(w, r, result.Err.Error())
@@ -0,0 +1,163 @@
+package hcfy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/translate"
+)
+
+// streamEvent is a line of the streaming response. There are three types of
+// events: "paragraph" carries a translated line with its original index,
+// "result" carries the final response, and "error" ends the stream with an
+// error.
+type streamEvent struct {
+	Type   string                   `json:"type"`
+	Index  int                      `json:"index"`
+	Text   string                   `json:"text,omitempty"`
+	Result *translate.TranslateResp `json:"result,omitempty"`
+	Error  string                   `json:"error,omitempty"`
+}
+
+type streamWriter struct {
+	w   http.ResponseWriter
+	sse bool
+}
+
+func newStreamWriter(w http.ResponseWriter, r *http.Request) *streamWriter {
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return &streamWriter{w: w, sse: sse}
+}
+
+func (s *streamWriter) write(ev *streamEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf("failed to marshal stream event: %s", err)
+		return
+	}
+	if s.sse {
+		fmt.Fprintf(s.w, "data: %s\n\n", data)
+	} else {
+		fmt.Fprintf(s.w, "%s\n", data)
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// HandleStream is the streaming variant of Handle. Every line is written as
+// soon as it's translated, in NDJSON by default, or in SSE if the client
+// accepts "text/event-stream".
+func HandleStream(w http.ResponseWriter, r *http.Request) {
+	if token := os.Getenv("PASSWORD"); token != "" {
+		if r.URL.Query().Get("pass") != token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("bad password"))
+			return
+		}
+	}
+	req := &translate.TranslateReq{}
+	if err := render.Bind(r, req); err != nil {
+		log.Debugf("bad request: %s", err)
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, "empty text")
+		return
+	}
+	ctx := r.Context()
+	ruleID, err := tokenBucket.Consume(ctx)
+	if err != nil {
+		log.Errorf("token bucket consume error: %s", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+	if translate.IsLookup(req.Text) {
+		result := lookup(ctx, req)
+		sw := newStreamWriter(w, r)
+		if result.Err != nil {
+			sw.write(&streamEvent{Type: "error", Error: result.Err.Error()})
+			return
+		}
+		for idx, line := range result.Resp.Result {
+			sw.write(&streamEvent{Type: "paragraph", Index: idx, Text: line})
+		}
+		sw.write(&streamEvent{Type: "result", Result: result.Resp})
+		return
+	}
+	// the sub requests should agree on the source, and so the destination
+	translate.SettleSource(req)
+	segs := translate.SplitSegments(req.Text)
+	subReqs := split(segs, ruleID)
+	log.Debugf("stream request has been splitted into %d sub requests", len(subReqs))
+
+	out := make(chan *translate.Paragraph, len(segs))
+	results := make([]*translate.TranslateResult, len(subReqs))
+	ch := make(chan struct{}, len(subReqs))
+	for idx, subReq := range subReqs {
+		idx := idx
+		subReq := subReq
+		go func() {
+			results[idx] = handleSubReq(ctx, req, subReq, idx != 0, out)
+			ch <- struct{}{}
+		}()
+	}
+
+	sw := newStreamWriter(w, r)
+	emitted := make([]bool, len(segs))
+	emit := func(idx int, text string) {
+		if idx < len(emitted) && !emitted[idx] {
+			emitted[idx] = true
+			sw.write(&streamEvent{Type: "paragraph", Index: idx, Text: text})
+		}
+	}
+	// the streamed lines are the bare content, put them back in the layout
+	emitStreamed := func(p *translate.Paragraph) {
+		if p.Index < len(segs) {
+			emit(p.Index, segs[p.Index].Apply(p.Text))
+		}
+	}
+	cnt := 0
+	for cnt < len(subReqs) {
+		select {
+		case p := <-out:
+			emitStreamed(p)
+		case <-ch:
+			cnt++
+		case <-ctx.Done():
+			log.Errorf("context done before all results are collected, cnt: %d, err: %s", cnt, ctx.Err())
+			return
+		}
+	}
+	for len(out) > 0 {
+		emitStreamed(<-out)
+	}
+
+	result := reconstructResult(req, segs, subReqs, results)
+	if result.Err != nil {
+		sw.write(&streamEvent{Type: "error", Error: result.Err.Error()})
+		return
+	}
+	// the backend may not support streaming, emit the lines that haven't
+	// been sent yet
+	for idx, line := range result.Resp.Result {
+		emit(idx, line)
+	}
+	sw.write(&streamEvent{Type: "result", Result: result.Resp})
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/zjx20/hcfy-gemini/cjsfy"
 	"github.com/zjx20/hcfy-gemini/config"
 	"github.com/zjx20/hcfy-gemini/hcfy"
+	"github.com/zjx20/hcfy-gemini/stats"
 	"github.com/zjx20/hcfy-gemini/util/middleware"
 
 	"github.com/go-chi/chi/v5"
@@ -38,7 +39,13 @@ func main() {
 	r.Use(middleware.Recover)
 
 	r.Post("/api/hcfy", hcfy.Handle)
+	r.Post("/api/hcfy/stream", hcfy.HandleStream)
 	r.Post("/api/cjsfy", cjsfy.Handle)
+	r.Post("/v1beta/models/{model}:generateContent", cjsfy.Handle)
+	r.Post("/v1beta/models/{model}:streamGenerateContent", cjsfy.HandleStream)
+	r.Post("/v1/chat/completions", cjsfy.HandleChatCompletions)
+	r.Get("/v1/models", cjsfy.HandleModels)
+	r.Get("/api/stats", stats.Handle)
 
 	l, err := net.Listen("tcp", ":7458")
 	if err != nil {
@@ -0,0 +1,21 @@
+package stats
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/go-chi/render"
+	"github.com/zjx20/hcfy-gemini/gemini"
+)
+
+// Handle reports the connection reuse of the genai clients.
+func Handle(w http.ResponseWriter, r *http.Request) {
+	if token := os.Getenv("PASSWORD"); token != "" {
+		if r.URL.Query().Get("pass") != token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("bad password"))
+			return
+		}
+	}
+	render.JSON(w, r, gemini.GetPoolStats())
+}
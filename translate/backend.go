@@ -0,0 +1,145 @@
+package translate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+// Backend is a translation provider. It takes a fully rendered prompt and
+// returns the raw text produced by the model, the session is responsible for
+// parsing it.
+type Backend interface {
+	Generate(ctx context.Context, req *BackendRequest) (*BackendResponse, error)
+}
+
+// StreamBackend is implemented by the backends that can stream the output,
+// onChunk is called with every piece of text as soon as it arrives.
+type StreamBackend interface {
+	Backend
+	GenerateStream(ctx context.Context, req *BackendRequest, onChunk func(text string)) (*BackendResponse, error)
+}
+
+type BackendRequest struct {
+	Prompt string
+	// Model overrides the model of the backend if not empty
+	Model string
+	// ResponseSchema asks the backend for a JSON output of the schema, only
+	// set it if the backend implements SchemaBackend and supports it.
+	ResponseSchema *Schema
+	// Generation is the generation parameters and safety settings
+	Generation config.GenerationConfig
+}
+
+// SchemaBackend is implemented by the backends that may support structured
+// JSON output. The model is the one of BackendRequest, empty for the
+// configured model.
+type SchemaBackend interface {
+	Backend
+	SupportsSchema(model string) bool
+}
+
+// TokenCounter is implemented by the backends that can count the tokens of a
+// prompt exactly, with the model like SchemaBackend.
+type TokenCounter interface {
+	Backend
+	CountTokens(ctx context.Context, model string, prompt string) (int, error)
+}
+
+// Schema describes a JSON value, it's a subset of the OpenAPI schema.
+type Schema struct {
+	Type        string // "object", "array", "string", "integer", "number" or "boolean"
+	Description string
+	Properties  map[string]*Schema
+	Items       *Schema
+	Required    []string
+}
+
+type BackendResponse struct {
+	Text  string
+	Usage Usage
+	// FinishReason is why the model stopped, empty if unknown
+	FinishReason  FinishReason
+	SafetyRatings []*SafetyRating
+}
+
+type FinishReason string
+
+const (
+	FinishStop       FinishReason = "stop"
+	FinishMaxTokens  FinishReason = "max_tokens"
+	FinishSafety     FinishReason = "safety"
+	FinishRecitation FinishReason = "recitation"
+	FinishOther      FinishReason = "other"
+)
+
+// SafetyRating is the rating of the output in a harm category.
+type SafetyRating struct {
+	Category    string
+	Probability string
+	Blocked     bool
+}
+
+// Usage is the token accounting reported by the backend, zero if unknown.
+type Usage struct {
+	PromptTokens int
+	OutputTokens int
+	TotalTokens  int
+}
+
+// BackendFactory creates a backend from the current config. It's called
+// every time the config changes.
+type BackendFactory func(cfg *config.Config) (Backend, error)
+
+const defaultBackend = "gemini"
+
+var (
+	backendMu        sync.Mutex
+	backendFactories = map[string]BackendFactory{}
+	backendName      string
+	backendInst      Backend
+)
+
+func init() {
+	config.AddConfigChangeCallback(func() {
+		backendMu.Lock()
+		defer backendMu.Unlock()
+		backendInst = nil
+	})
+}
+
+// RegisterBackend makes a backend available under the given name, which can
+// then be selected by the "backend" field in config.json.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	backendFactories[strings.ToLower(name)] = factory
+	backendInst = nil
+}
+
+func getBackend() (Backend, error) {
+	cfg := config.ReadConfig()
+	name := strings.ToLower(cfg.Backend)
+	if name == "" {
+		name = defaultBackend
+	}
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backendInst != nil && backendName == name {
+		return backendInst, nil
+	}
+	factory, ok := backendFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+	b, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backend %q: %w", name, err)
+	}
+	backendName = name
+	backendInst = b
+	return b, nil
+}
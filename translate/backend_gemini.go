@@ -0,0 +1,304 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+	"github.com/zjx20/hcfy-gemini/gemini"
+	"google.golang.org/api/googleapi"
+)
+
+func init() {
+	RegisterBackend("gemini", newGeminiBackend)
+}
+
+// geminiKeys is shared by the backends created for every config, so that the
+// cool-downs and the quotas of the keys survive the reloads.
+var (
+	geminiKeysMu sync.Mutex
+	geminiKeys   *gemini.KeyRing
+)
+
+func keyRing(cfg *config.Config, apiKeys []string) *gemini.KeyRing {
+	geminiKeysMu.Lock()
+	defer geminiKeysMu.Unlock()
+	if geminiKeys == nil {
+		geminiKeys = gemini.NewKeyRing(apiKeys, config.GetRPMPerKey(),
+			config.GetKeyCooldown(), cfg.KeySelection)
+	} else {
+		geminiKeys.Update(apiKeys, config.GetRPMPerKey(),
+			config.GetKeyCooldown(), cfg.KeySelection)
+	}
+	return geminiKeys
+}
+
+type geminiBackend struct {
+	keys      *gemini.KeyRing
+	modelName string
+	endpoint  string
+}
+
+func newGeminiBackend(cfg *config.Config) (Backend, error) {
+	apiKeys := config.GetAPIKeys()
+	if len(apiKeys) == 0 {
+		return nil, fmt.Errorf("GEMINI_API_KEY is not defined")
+	}
+	modelName := cfg.ModelName
+	if modelName == "" {
+		modelName = os.Getenv("MODEL_NAME")
+	}
+	return &geminiBackend{
+		keys:      keyRing(cfg, apiKeys),
+		modelName: modelName,
+		endpoint:  cfg.Endpoint,
+	}, nil
+}
+
+func (b *geminiBackend) Generate(ctx context.Context, req *BackendRequest) (*BackendResponse, error) {
+	return b.withKey(func(cfg gemini.GenerateTextConfig) (*gemini.GenerateTextResult, bool, error) {
+		setRequest(&cfg, req)
+		result, err := gemini.GenerateText(ctx, cfg)
+		return result, true, err
+	})
+}
+
+func (b *geminiBackend) GenerateStream(ctx context.Context, req *BackendRequest, onChunk func(text string)) (*BackendResponse, error) {
+	return b.withKey(func(cfg gemini.GenerateTextConfig) (*gemini.GenerateTextResult, bool, error) {
+		setRequest(&cfg, req)
+		emitted := false
+		result, err := gemini.GenerateTextStream(ctx, cfg, func(text string) {
+			emitted = true
+			onChunk(text)
+		})
+		// it's too late to switch the key once something has been emitted
+		return result, !emitted, err
+	})
+}
+
+func setRequest(cfg *gemini.GenerateTextConfig, req *BackendRequest) {
+	cfg.Prompt = req.Prompt
+	if req.Model != "" {
+		cfg.ModelName = req.Model
+	}
+	cfg.ResponseSchema = toGenaiSchema(req.ResponseSchema)
+	gen := req.Generation
+	cfg.Generation = genai.GenerationConfig{
+		Temperature:     gen.Temperature,
+		TopP:            gen.TopP,
+		TopK:            gen.TopK,
+		MaxOutputTokens: gen.MaxOutputTokens,
+		CandidateCount:  gen.CandidateCount,
+		StopSequences:   gen.StopSequences,
+	}
+	cfg.SafetySettings = toSafetySettings(gen.Safety)
+}
+
+var (
+	finishReasons = map[genai.FinishReason]FinishReason{
+		genai.FinishReasonStop:       FinishStop,
+		genai.FinishReasonMaxTokens:  FinishMaxTokens,
+		genai.FinishReasonSafety:     FinishSafety,
+		genai.FinishReasonRecitation: FinishRecitation,
+		genai.FinishReasonOther:      FinishOther,
+	}
+	harmCategories = map[string]genai.HarmCategory{
+		"harassment":        genai.HarmCategoryHarassment,
+		"hate_speech":       genai.HarmCategoryHateSpeech,
+		"sexually_explicit": genai.HarmCategorySexuallyExplicit,
+		"dangerous_content": genai.HarmCategoryDangerousContent,
+	}
+	harmThresholds = map[string]genai.HarmBlockThreshold{
+		"block_none":             genai.HarmBlockNone,
+		"block_only_high":        genai.HarmBlockOnlyHigh,
+		"block_medium_and_above": genai.HarmBlockMediumAndAbove,
+		"block_low_and_above":    genai.HarmBlockLowAndAbove,
+	}
+)
+
+func toSafetySettings(safety map[string]string) []*genai.SafetySetting {
+	var settings []*genai.SafetySetting
+	for category, threshold := range safety {
+		c, ok := harmCategories[strings.ToLower(category)]
+		if !ok {
+			log.Warnf("unknown harm category %q", category)
+			continue
+		}
+		t, ok := harmThresholds[strings.ToLower(threshold)]
+		if !ok {
+			log.Warnf("unknown harm block threshold %q", threshold)
+			continue
+		}
+		settings = append(settings, &genai.SafetySetting{Category: c, Threshold: t})
+	}
+	return settings
+}
+
+func (b *geminiBackend) CountTokens(ctx context.Context, model string, prompt string) (int, error) {
+	apiKey, err := b.keys.Acquire(nil)
+	if err != nil {
+		return 0, classifyGeminiError(err)
+	}
+	n, err := gemini.CountTokens(ctx, gemini.GenerateTextConfig{
+		APIKey:    apiKey,
+		ModelName: b.model(model),
+		Endpoint:  b.endpoint,
+		Prompt:    prompt,
+	})
+	b.keys.Release(apiKey, err)
+	if err != nil {
+		return 0, classifyGeminiError(err)
+	}
+	return n, nil
+}
+
+// model is the model in effect, the one of the request or the configured one.
+func (b *geminiBackend) model(model string) string {
+	if model != "" {
+		return model
+	}
+	return b.modelName
+}
+
+// SupportsSchema reports whether the model supports structured output, the
+// legacy gemini-pro and gemini-1.0 models don't.
+func (b *geminiBackend) SupportsSchema(model string) bool {
+	name := strings.TrimPrefix(b.model(model), "models/")
+	return name != "" && name != "gemini-pro" && !strings.HasPrefix(name, "gemini-1.0")
+}
+
+func toGenaiSchema(s *Schema) *genai.Schema {
+	if s == nil {
+		return nil
+	}
+	gs := &genai.Schema{
+		Description: s.Description,
+		Items:       toGenaiSchema(s.Items),
+		Required:    s.Required,
+	}
+	switch s.Type {
+	case "object":
+		gs.Type = genai.TypeObject
+	case "array":
+		gs.Type = genai.TypeArray
+	case "string":
+		gs.Type = genai.TypeString
+	case "integer":
+		gs.Type = genai.TypeInteger
+	case "number":
+		gs.Type = genai.TypeNumber
+	case "boolean":
+		gs.Type = genai.TypeBoolean
+	}
+	if len(s.Properties) > 0 {
+		gs.Properties = make(map[string]*genai.Schema, len(s.Properties))
+		for k, v := range s.Properties {
+			gs.Properties[k] = toGenaiSchema(v)
+		}
+	}
+	return gs
+}
+
+// withKey runs call with an API key from the key ring, and fails over to
+// another key if the current one is rejected and call is retryable.
+func (b *geminiBackend) withKey(call func(cfg gemini.GenerateTextConfig) (*gemini.GenerateTextResult, bool, error)) (*BackendResponse, error) {
+	tried := map[string]bool{}
+	for {
+		apiKey, err := b.keys.Acquire(tried)
+		if err != nil {
+			return nil, classifyGeminiError(err)
+		}
+		tried[apiKey] = true
+		result, retryable, err := call(gemini.GenerateTextConfig{
+			APIKey:    apiKey,
+			ModelName: b.modelName,
+			Endpoint:  b.endpoint,
+		})
+		if b.keys.Release(apiKey, err) && retryable && len(tried) < b.keys.Len() {
+			log.Warnf("retry with another API key")
+			continue
+		}
+		if err != nil {
+			return nil, classifyGeminiError(err)
+		}
+		resp := &BackendResponse{
+			Text: result.Text,
+			Usage: Usage{
+				PromptTokens: result.PromptTokens,
+				OutputTokens: result.OutputTokens,
+				TotalTokens:  result.TotalTokens,
+			},
+			FinishReason: finishReasons[result.FinishReason],
+		}
+		for _, r := range result.SafetyRatings {
+			resp.SafetyRatings = append(resp.SafetyRatings, &SafetyRating{
+				Category:    r.Category.String(),
+				Probability: r.Probability.String(),
+				Blocked:     r.Blocked,
+			})
+		}
+		return resp, nil
+	}
+}
+
+func classifyGeminiError(err error) error {
+	be := &BackendError{Class: ErrRetryable, Err: err}
+	var gerr *googleapi.Error
+	var blocked *genai.BlockedError
+	var exhausted *gemini.KeysExhaustedError
+	if errors.As(err, &blocked) || errors.Is(err, context.Canceled) {
+		be.Class = ErrFatal
+	} else if errors.As(err, &exhausted) {
+		// wait for the keys rather than overusing them
+		be.Class = ErrRateLimited
+		be.RetryAfter = exhausted.RetryAfter
+	} else if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == http.StatusTooManyRequests:
+			be.Class = ErrRateLimited
+			be.RetryAfter = retryAfter(gerr)
+		case gerr.Code == http.StatusRequestTimeout || gerr.Code >= 500:
+			be.Class = ErrRetryable
+			be.RetryAfter = retryAfter(gerr)
+		case gerr.Code >= 400:
+			// invalid API key, permission denied, unknown model, ...
+			be.Class = ErrFatal
+		}
+	}
+	return be
+}
+
+// retryAfter reads the delay from the Retry-After header, or the RetryInfo
+// in the error details.
+func retryAfter(gerr *googleapi.Error) time.Duration {
+	if v := gerr.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return time.Until(t)
+		}
+	}
+	for _, detail := range gerr.Details {
+		m, ok := detail.(map[string]interface{})
+		if !ok || !strings.HasSuffix(fmt.Sprint(m["@type"]), "google.rpc.RetryInfo") {
+			continue
+		}
+		if delay, ok := m["retryDelay"].(string); ok {
+			if d, err := time.ParseDuration(delay); err == nil {
+				return d
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,276 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+// fakeBackend "translates" every paragraph of the prompt to its upper case.
+type fakeBackend struct {
+	mu      sync.Mutex
+	inputs  [][]string
+	prompts []string
+	// drop is called for every paragraph, the paragraph is left out of the
+	// output if it returns true
+	drop func(p string) bool
+	// answer is returned as is if not empty
+	answer string
+	// truncate reports whether the output of the input paragraphs is cut off
+	// by the output limit
+	truncate func(input []string) bool
+}
+
+func (b *fakeBackend) Generate(ctx context.Context, req *BackendRequest) (*BackendResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.answer != "" {
+		b.prompts = append(b.prompts, req.Prompt)
+		return &BackendResponse{Text: b.answer}, nil
+	}
+	content := req.Prompt[strings.LastIndex(req.Prompt, "个段落："):]
+	var input []string
+	out := "英语 -> 中文\n"
+	for {
+		p, rest, ok := nextParagraph(content)
+		if !ok {
+			break
+		}
+		content = rest
+		input = append(input, p.text)
+		if b.drop != nil && b.drop(p.text) {
+			continue
+		}
+		out += beginMarkerOf(p.id) + "\n" + strings.ToUpper(p.text) + "\n" + endMarkerOf(p.id) + "\n"
+	}
+	b.inputs = append(b.inputs, input)
+	b.prompts = append(b.prompts, req.Prompt)
+	if b.truncate != nil && b.truncate(input) {
+		return &BackendResponse{Text: out[:len(out)/2], FinishReason: FinishMaxTokens}, nil
+	}
+	return &BackendResponse{Text: out, FinishReason: FinishStop}, nil
+}
+
+func useFakeBackend(t *testing.T) *fakeBackend {
+	fake := &fakeBackend{}
+	RegisterBackend("fake", func(cfg *config.Config) (Backend, error) {
+		return fake, nil
+	})
+	config.ReadConfig().Backend = "fake"
+	t.Cleanup(func() {
+		config.ReadConfig().Backend = ""
+	})
+	return fake
+}
+
+func TestFakeBackend(t *testing.T) {
+	fake := useFakeBackend(t)
+	ch := make(chan *TranslateResult, 1)
+	Translate2(context.Background(), []string{"hello", "world"}, "中文", ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	expect := &TranslateResp{
+		Text:   "hello\nworld",
+		From:   "英语",
+		To:     "中文",
+		Result: []string{"HELLO", "WORLD"},
+	}
+	if !reflect.DeepEqual(result.Resp, expect) {
+		t.Errorf("bad result, expected: %+v, actual: %+v", expect, result.Resp)
+	}
+	if !reflect.DeepEqual(fake.inputs, [][]string{{"hello", "world"}}) {
+		t.Errorf("unexpected inputs: %q", fake.inputs)
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	fake := useFakeBackend(t)
+	dropped := false
+	fake.drop = func(p string) bool {
+		if p == "b" && !dropped {
+			dropped = true
+			return true
+		}
+		return false
+	}
+	ch := make(chan *TranslateResult, 1)
+	Translate2(context.Background(), []string{"a", "b", "c"}, "中文", ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if expect := []string{"A", "B", "C"}; !reflect.DeepEqual(result.Resp.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, result.Resp.Result)
+	}
+	if expect := [][]string{{"a", "b", "c"}, {"b"}}; !reflect.DeepEqual(fake.inputs, expect) {
+		t.Errorf("only the missing paragraph should be requested again, expected: %q, actual: %q",
+			expect, fake.inputs)
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	fake := useFakeBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch := make(chan *TranslateResult, 1)
+	Translate2(ctx, []string{"hello"}, "中文", ch)
+	result := <-ch
+	if !errors.Is(result.Err, context.Canceled) {
+		t.Errorf("expect canceled error, got: %v", result.Err)
+	}
+	if len(fake.inputs) != 0 {
+		t.Errorf("the backend should not be called, inputs: %q", fake.inputs)
+	}
+}
+
+func TestSourceLanguage(t *testing.T) {
+	fake := useFakeBackend(t)
+	ch := make(chan *TranslateResult, 1)
+	Translate(context.Background(), &TranslateReq{
+		Text:        "这个问题我们明天再说",
+		Destination: []string{"中文(简体)", "英语"},
+	}, ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if result.Resp.From != "中文(简体)" || result.Resp.To != "英语" {
+		t.Errorf("bad languages, from: %s, to: %s", result.Resp.From, result.Resp.To)
+	}
+	if prompt := fake.prompts[0]; !strings.Contains(prompt, "原文是中文(简体)，请把内容翻译成英语，") {
+		t.Errorf("the prompt should translate to the second destination: %s", prompt)
+	}
+
+	Translate(context.Background(), &TranslateReq{
+		Text:        "hello",
+		Destination: []string{"中文(简体)", "英语"},
+		Source:      "英语",
+	}, ch)
+	result = <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if result.Resp.From != "英语" || result.Resp.To != "中文(简体)" {
+		t.Errorf("bad languages, from: %s, to: %s", result.Resp.From, result.Resp.To)
+	}
+}
+
+func TestSettleSource(t *testing.T) {
+	cases := []struct {
+		text   string
+		source string
+		expect string
+	}{
+		{"这个问题我们明天再说\nok", "auto", "zh-Hans"},
+		{"这个问题我们明天再说", "英语", "英语"},
+		{"42", "", ""},
+	}
+	for _, c := range cases {
+		req := &TranslateReq{Text: c.text, Source: c.source}
+		SettleSource(req)
+		if req.Source != c.expect {
+			t.Errorf("bad source of %q, expected: %q, actual: %q", c.text, c.expect, req.Source)
+		}
+	}
+}
+
+func TestLanguageCodes(t *testing.T) {
+	fake := useFakeBackend(t)
+	ch := make(chan *TranslateResult, 1)
+	Translate(context.Background(), &TranslateReq{
+		Text:        "hello",
+		Destination: []string{"zh-CN", "en"},
+		Source:      "English",
+	}, ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if result.Resp.From != "en" || result.Resp.To != "zh-Hans" {
+		t.Errorf("bad languages, from: %s, to: %s", result.Resp.From, result.Resp.To)
+	}
+	if prompt := fake.prompts[0]; !strings.Contains(prompt, "原文是英语，请把内容翻译成中文(简体)，") {
+		t.Errorf("the prompt should use the language names: %s", prompt)
+	}
+}
+
+func TestMarkup(t *testing.T) {
+	fake := useFakeBackend(t)
+	ch := make(chan *TranslateResult, 1)
+	Translate2(context.Background(), []string{"run `go build` and <b>see</b>"}, "中文", ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if expect := []string{"RUN `go build` AND <b>SEE</b>"}; !reflect.DeepEqual(result.Resp.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, result.Resp.Result)
+	}
+	if expect := [][]string{{"run ⟦0⟧ and ⟦1⟧see⟦2⟧"}}; !reflect.DeepEqual(fake.inputs, expect) {
+		t.Errorf("the markup should be protected, inputs: %q", fake.inputs)
+	}
+	if !strings.Contains(fake.prompts[0], "占位符") {
+		t.Errorf("the prompt should explain the placeholders")
+	}
+}
+
+func TestAllDestinations(t *testing.T) {
+	fake := useFakeBackend(t)
+	ch := make(chan *TranslateResult, 1)
+	Translate(context.Background(), &TranslateReq{
+		Text:            "这个问题\n我们明天再说",
+		Destination:     []string{"英语", "日语"},
+		AllDestinations: true,
+	}, ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	resp := result.Resp
+	if resp.From != "中文(简体)" || resp.To != "英语" || len(resp.Translations) != 2 {
+		t.Fatalf("bad response: %+v", resp)
+	}
+	for idx, to := range []string{"英语", "日语"} {
+		tr := resp.Translations[idx]
+		if tr.To != to || !reflect.DeepEqual(tr.Result, []string{"这个问题", "我们明天再说"}) {
+			t.Errorf("bad translation %d: %+v", idx, tr)
+		}
+	}
+	if len(fake.prompts) != 1 || !strings.Contains(fake.prompts[0], "====翻译成日语====") {
+		t.Errorf("all the destinations should be requested in one call: %q", fake.prompts)
+	}
+
+	// the text is already in the first destination
+	fake.prompts = nil
+	Translate(context.Background(), &TranslateReq{
+		Text:            "hello\nworld",
+		Destination:     []string{"en", "zh-CN"},
+		Source:          "English",
+		AllDestinations: true,
+	}, ch)
+	result = <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	expect := []*DestTranslation{
+		{To: "en", Result: []string{"hello", "world"}},
+		{To: "zh-Hans", Result: []string{"HELLO", "WORLD"}},
+	}
+	if result.Resp.From != "en" || len(result.Resp.Translations) != len(expect) {
+		t.Fatalf("bad response: %+v", result.Resp)
+	}
+	for idx, tr := range result.Resp.Translations {
+		if idx >= len(expect) || !reflect.DeepEqual(tr, expect[idx]) {
+			t.Errorf("bad translation %d: %+v", idx, tr)
+		}
+	}
+	if len(fake.prompts) != 1 || strings.Contains(fake.prompts[0], "====翻译成英语====") {
+		t.Errorf("the source language should not be requested: %q", fake.prompts)
+	}
+}
@@ -0,0 +1,394 @@
+package translate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+	"github.com/zjx20/hcfy-gemini/util/lru"
+)
+
+const (
+	defaultCacheEntries     = 10000
+	defaultDiskCacheEntries = 100000
+	defaultCacheTTL         = 7 * 24 * time.Hour
+)
+
+type cacheEntry struct {
+	Text     string `json:"text"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+// paragraphCache caches the translation of single paragraphs, with an
+// in-memory LRU tier and an optional on-disk tier.
+type paragraphCache struct {
+	mem  *lru.Cache[string, *cacheEntry]
+	disk *diskCache
+	ttl  time.Duration
+}
+
+var (
+	cacheMu   sync.Mutex
+	cacheInst *paragraphCache
+	cacheInit bool
+)
+
+func init() {
+	config.AddConfigChangeCallback(func() {
+		cacheMu.Lock()
+		defer cacheMu.Unlock()
+		cacheInst = nil
+		cacheInit = false
+	})
+}
+
+// getCache returns nil if the cache is disabled.
+func getCache() *paragraphCache {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if cacheInit {
+		return cacheInst
+	}
+	cacheInit = true
+	cacheInst = nil
+	cfg := config.ReadConfig().Cache
+	if !cfg.Enabled {
+		return nil
+	}
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	ttl := time.Duration(cfg.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	c := &paragraphCache{
+		mem: lru.New[string, *cacheEntry](maxEntries, ttl),
+		ttl: ttl,
+	}
+	if cfg.DiskDir != "" {
+		maxDiskEntries := cfg.DiskMaxEntries
+		if maxDiskEntries <= 0 {
+			maxDiskEntries = defaultDiskCacheEntries
+		}
+		disk, err := newDiskCache(cfg.DiskDir, maxDiskEntries)
+		if err != nil {
+			log.Errorf("failed to open disk cache, err: %s", err)
+		} else {
+			c.disk = disk
+		}
+	}
+	cacheInst = c
+	return c
+}
+
+// promptVersion identifies the prompts, so that a change of the prompts
+// invalidates the cache.
+func promptVersion() string {
+	h := sha256.New()
+	h.Write([]byte(promptSource()))
+	vars := config.ReadConfig().PromptVars
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		h.Write([]byte(k + "=" + vars[k]))
+	}
+	h.Write([]byte(config.ReadConfig().OutputMode))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func cacheModel() string {
+	cfg := config.ReadConfig()
+	model := cfg.ModelName
+	if model == "" {
+		model = os.Getenv("MODEL_NAME")
+	}
+	return cfg.Backend + "/" + model
+}
+
+func normalizeParagraph(p string) string {
+	return strings.Join(strings.Fields(p), " ")
+}
+
+// cacheKey identifies the translation of the paragraph, generation is the
+// JSON of the generation parameters in effect, glossary is the glossaryDigest
+// of the entries that appear in the paragraph.
+func cacheKey(p string, dest []string, source string, model string, generation string, glossary string,
+	version string) string {
+	if strings.EqualFold(source, "auto") {
+		source = ""
+	}
+	h := sha256.New()
+	for _, s := range []string{normalizeParagraph(p), strings.Join(dest, ","), source, model, generation, glossary, version} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *paragraphCache) get(key string) *cacheEntry {
+	if e, ok := c.mem.Get(key); ok {
+		return e
+	}
+	if c.disk == nil {
+		return nil
+	}
+	e := c.disk.get(key)
+	if e != nil {
+		c.mem.Put(key, e)
+	}
+	return e
+}
+
+func (c *paragraphCache) put(key string, e *cacheEntry) {
+	e.ExpireAt = time.Now().Add(c.ttl).Unix()
+	c.mem.Put(key, e)
+	if c.disk != nil {
+		c.disk.put(key, e)
+	}
+}
+
+type diskCache struct {
+	dir        string
+	maxEntries int
+	count      atomic.Int64
+	pruning    atomic.Bool
+}
+
+func newDiskCache(dir string, maxEntries int) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &diskCache{
+		dir:        dir,
+		maxEntries: maxEntries,
+	}
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(path, ".json") {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.count.Store(int64(count))
+	return d, nil
+}
+
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, key[:2], key+".json")
+}
+
+func (d *diskCache) get(key string) *cacheEntry {
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		return nil
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil
+	}
+	if time.Now().Unix() > e.ExpireAt {
+		if os.Remove(d.path(key)) == nil {
+			d.count.Add(-1)
+		}
+		return nil
+	}
+	return e
+}
+
+func (d *diskCache) put(key string, e *cacheEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Errorf("failed to write disk cache, err: %s", err)
+		return
+	}
+	_, statErr := os.Stat(path)
+	tmp := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Errorf("failed to write disk cache, err: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		log.Errorf("failed to write disk cache, err: %s", err)
+		return
+	}
+	if statErr != nil && d.count.Add(1) > int64(d.maxEntries) && d.pruning.CompareAndSwap(false, true) {
+		go d.prune()
+	}
+}
+
+// prune removes the least recently written entries, until the cache is
+// shrunk to 90% of its capacity.
+func (d *diskCache) prune() {
+	defer d.pruning.Store(false)
+	type file struct {
+		path    string
+		modTime time.Time
+	}
+	var files []file
+	filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			files = append(files, file{path, info.ModTime()})
+		}
+		return nil
+	})
+	slices.SortFunc(files, func(a, b file) int {
+		return a.modTime.Compare(b.modTime)
+	})
+	target := d.maxEntries * 9 / 10
+	removed := 0
+	for len(files)-removed > target {
+		os.Remove(files[removed].path)
+		removed++
+	}
+	d.count.Store(int64(len(files) - removed))
+	log.Debugf("pruned %d entries from disk cache", removed)
+}
+
+// startSession translates the paragraphs that are not in the cache, and
+// merges the cached ones into the result.
+func startSession(ctx context.Context, dest []string, input []string, ch chan *TranslateResult, opts sessionOptions) {
+	c := getCache()
+	if c == nil {
+		go goFire(newSession(ctx, dest, input, ch, opts))
+		return
+	}
+	paraCh := opts.paraCh
+	model := cacheModel()
+	if opts.model != "" {
+		model = config.ReadConfig().Backend + "/" + opts.model
+	}
+	version := promptVersion()
+	generation, _ := json.Marshal(config.GetGenerationConfig(opts.endpoint).Merge(opts.generation))
+	keys := make([]string, len(input))
+	hits := make([]*cacheEntry, len(input))
+	var missIdx []int
+	var missInput []string
+	for idx, p := range input {
+		d := dest
+		if opts.targets != nil {
+			d = []string{opts.targets[idx]}
+		}
+		glossary := glossaryDigest(matchGlossary(d, []string{p}))
+		keys[idx] = cacheKey(p, d, opts.source, model, string(generation), glossary, version)
+		if hits[idx] = c.get(keys[idx]); hits[idx] == nil {
+			missIdx = append(missIdx, idx)
+			missInput = append(missInput, p)
+		} else if paraCh != nil {
+			paraCh <- &Paragraph{Index: idx, Text: hits[idx].Text}
+		}
+	}
+	log.Debugf("cache hit %d/%d", len(input)-len(missInput), len(input))
+
+	merge := func(resp *TranslateResp) *TranslateResult {
+		merged := &TranslateResp{
+			Text:   strings.Join(input, "\n"),
+			Result: make([]string, len(input)),
+		}
+		if resp != nil {
+			merged.From, merged.To = resp.From, resp.To
+			for i, idx := range missIdx {
+				merged.Result[idx] = resp.Result[i]
+			}
+		}
+		for idx, e := range hits {
+			if e == nil {
+				continue
+			}
+			merged.Result[idx] = e.Text
+			if merged.From == "" {
+				merged.From, merged.To = e.From, e.To
+			}
+		}
+		return &TranslateResult{Resp: merged}
+	}
+	if len(missIdx) == 0 {
+		ch <- merge(nil)
+		return
+	}
+
+	innerCh := make(chan *TranslateResult, 1)
+	var innerParaCh chan *Paragraph
+	if paraCh != nil {
+		innerParaCh = make(chan *Paragraph, len(missInput))
+	}
+	innerOpts := opts
+	innerOpts.paraCh = innerParaCh
+	if opts.targets != nil {
+		innerOpts.targets = make([]string, len(missIdx))
+		for i, idx := range missIdx {
+			innerOpts.targets[i] = opts.targets[idx]
+		}
+	}
+	go goFire(newSession(ctx, dest, missInput, innerCh, innerOpts))
+	go func() {
+		for {
+			select {
+			case p := <-innerParaCh:
+				paraCh <- &Paragraph{Index: missIdx[p.Index], Text: p.Text}
+			case result := <-innerCh:
+				for len(innerParaCh) > 0 {
+					p := <-innerParaCh
+					paraCh <- &Paragraph{Index: missIdx[p.Index], Text: p.Text}
+				}
+				if result.Err != nil {
+					ch <- result
+					return
+				}
+				if len(result.Resp.Result) != len(missInput) {
+					ch <- &TranslateResult{
+						Err: fmt.Errorf("number of translation result (%d) doesn't match the request (%d)",
+							len(result.Resp.Result), len(missInput)),
+					}
+					return
+				}
+				for i, idx := range missIdx {
+					to := result.Resp.To
+					if opts.targets != nil {
+						to = opts.targets[idx]
+					}
+					if violatesGlossary(to, input[idx], result.Resp.Result[i]) {
+						// it may be corrected next time
+						continue
+					}
+					c.put(keys[idx], &cacheEntry{
+						Text: result.Resp.Result[i],
+						From: result.Resp.From,
+						To:   result.Resp.To,
+					})
+				}
+				ch <- merge(result.Resp)
+				return
+			}
+		}
+	}()
+}
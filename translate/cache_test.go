@@ -0,0 +1,105 @@
+package translate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+func TestCache(t *testing.T) {
+	fake := useFakeBackend(t)
+	config.ReadConfig().Cache = config.CacheConfig{Enabled: true, DiskDir: t.TempDir()}
+	cacheInit = false
+	t.Cleanup(func() {
+		config.ReadConfig().Cache = config.CacheConfig{}
+		config.ReadConfig().Generation = config.GenerationConfig{}
+		cacheInit = false
+	})
+
+	ch := make(chan *TranslateResult, 1)
+	Translate2(context.Background(), []string{"hello", "world"}, "中文", ch)
+	if result := <-ch; result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	Translate2(context.Background(), []string{"foo", "hello", " world "}, "中文", ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if expect := []string{"FOO", "HELLO", "WORLD"}; !reflect.DeepEqual(result.Resp.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, result.Resp.Result)
+	}
+	if expect := [][]string{{"hello", "world"}, {"foo"}}; !reflect.DeepEqual(fake.inputs, expect) {
+		t.Errorf("only the misses should be sent, expected: %q, actual: %q", expect, fake.inputs)
+	}
+
+	// the disk tier survives a restart
+	cacheInit = false
+	Translate2(context.Background(), []string{"foo"}, "中文", ch)
+	if result := <-ch; result.Err != nil || result.Resp.Result[0] != "FOO" {
+		t.Errorf("bad result: %+v", result)
+	}
+	if len(fake.inputs) != 2 {
+		t.Errorf("should be served by the disk cache, inputs: %q", fake.inputs)
+	}
+
+	// other generation parameters make another translation
+	temperature := float32(0.5)
+	config.ReadConfig().Generation = config.GenerationConfig{Temperature: &temperature}
+	Translate2(context.Background(), []string{"foo"}, "中文", ch)
+	if result := <-ch; result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if len(fake.inputs) != 3 {
+		t.Errorf("should not be served by the cache, inputs: %q", fake.inputs)
+	}
+}
+
+func TestCacheGlossary(t *testing.T) {
+	fake := useFakeBackend(t)
+	config.ReadConfig().Cache = config.CacheConfig{Enabled: true}
+	cacheInit = false
+	useGlossary := func(entry string) {
+		path := filepath.Join(t.TempDir(), "zh.csv")
+		os.WriteFile(path, []byte(entry), 0o644)
+		g, err := loadGlossary(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		glossaries.Store(&map[string]*glossary{glossaryKey("中文"): g})
+	}
+	t.Cleanup(func() {
+		config.ReadConfig().Cache = config.CacheConfig{}
+		cacheInit = false
+		glossaries.Store(&map[string]*glossary{})
+	})
+
+	// the fake translation keeps the term, which violates the glossary
+	useGlossary("foo,bar\n")
+	ch := make(chan *TranslateResult, 1)
+	for i := 0; i < 2; i++ {
+		Translate2(context.Background(), []string{"foo"}, "中文", ch)
+		if result := <-ch; result.Err != nil {
+			t.Fatalf("unexpected error: %s", result.Err)
+		}
+	}
+	if len(fake.inputs) != 2 {
+		t.Errorf("the translation violating the glossary should not be cached, inputs: %q", fake.inputs)
+	}
+
+	// another rendering of the term makes another translation
+	useGlossary("foo,\n")
+	for i := 0; i < 2; i++ {
+		Translate2(context.Background(), []string{"foo"}, "中文", ch)
+		if result := <-ch; result.Err != nil {
+			t.Fatalf("unexpected error: %s", result.Err)
+		}
+	}
+	if len(fake.inputs) != 3 {
+		t.Errorf("should be cached once it follows the glossary, inputs: %q", fake.inputs)
+	}
+}
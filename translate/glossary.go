@@ -0,0 +1,243 @@
+package translate
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+	"github.com/zjx20/hcfy-gemini/util/lang"
+)
+
+// GlossaryEntry is a term and its rendering in the destination language, an
+// empty Translation means the term should be kept untranslated.
+type GlossaryEntry struct {
+	Term        string `json:"term"`
+	Translation string `json:"translation"`
+}
+
+// Rendering is what the term should look like in the translation.
+func (e *GlossaryEntry) Rendering() string {
+	if e.Translation == "" {
+		return e.Term
+	}
+	return e.Translation
+}
+
+type glossary struct {
+	entries []*GlossaryEntry
+}
+
+// glossaries are indexed by the glossaryKey of the destination language
+var glossaries atomic.Pointer[map[string]*glossary]
+
+func init() {
+	empty := map[string]*glossary{}
+	glossaries.Store(&empty)
+	config.AddConfigChangeCallback(loadGlossaries)
+}
+
+func loadGlossaries() {
+	loaded := map[string]*glossary{}
+	for dest, path := range config.ReadConfig().Glossaries {
+		g, err := loadGlossary(path)
+		if err != nil {
+			log.Errorf("failed to load glossary for %s from %s, err: %s", dest, path, err)
+			if old := getGlossary(dest); old != nil {
+				loaded[glossaryKey(dest)] = old
+			}
+			continue
+		}
+		log.Infof("loaded %d glossary entries for %s from %s", len(g.entries), dest, path)
+		loaded[glossaryKey(dest)] = g
+	}
+	glossaries.Store(&loaded)
+}
+
+// glossaryKey is the code of the language if it's known, so that a glossary
+// configured for "英语" also applies to "en" and "English".
+func glossaryKey(dest string) string {
+	if l := lang.Lookup(dest); l != nil {
+		return l.Code
+	}
+	return strings.ToLower(strings.TrimSpace(dest))
+}
+
+func getGlossary(dest string) *glossary {
+	return (*glossaries.Load())[glossaryKey(dest)]
+}
+
+// loadGlossary reads a CSV file with "term,translation" rows, or a JSON file
+// with a {"term": "translation"} object.
+func loadGlossary(path string) (*glossary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g := &glossary{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var m map[string]string
+		if err := json.NewDecoder(f).Decode(&m); err != nil {
+			return nil, err
+		}
+		for term, translation := range m {
+			g.add(term, translation)
+		}
+		return g, nil
+	}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "term") {
+			continue // header
+		}
+		switch len(record) {
+		case 1:
+			g.add(record[0], "")
+		case 2:
+			g.add(record[0], record[1])
+		default:
+			return nil, fmt.Errorf("line %d: expect 1 or 2 fields, got %d", line, len(record))
+		}
+	}
+	return g, nil
+}
+
+func (g *glossary) add(term string, translation string) {
+	term = strings.TrimSpace(term)
+	if term == "" {
+		return
+	}
+	g.entries = append(g.entries, &GlossaryEntry{
+		Term:        term,
+		Translation: strings.TrimSpace(translation),
+	})
+}
+
+// containsTerm reports whether the term appears in the text, regardless of
+// the case. The Latin-script terms are matched on word boundaries, so "Go"
+// isn't found in "good", while the CJK ones are matched as substrings.
+func containsTerm(text string, term string) bool {
+	text = strings.ToLower(text)
+	term = strings.ToLower(term)
+	if term == "" {
+		return false
+	}
+	first, _ := utf8.DecodeRuneInString(term)
+	last, _ := utf8.DecodeLastRuneInString(term)
+	for start := 0; ; {
+		i := strings.Index(text[start:], term)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(term)
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !(isWordRune(first) && isWordRune(before)) && !(isWordRune(last) && isWordRune(after)) {
+			return true
+		}
+		_, size := utf8.DecodeRuneInString(text[i:])
+		start = i + size
+	}
+}
+
+// isWordRune reports whether r is a part of a word that is delimited by
+// spaces or punctuation, i.e. not a CJK character.
+func isWordRune(r rune) bool {
+	if r == utf8.RuneError {
+		return false
+	}
+	if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+		return false
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// match returns the entries that appear in the input.
+func (g *glossary) match(input []string) []*GlossaryEntry {
+	var matched []*GlossaryEntry
+	for _, e := range g.entries {
+		for _, p := range input {
+			if containsTerm(p, e.Term) {
+				matched = append(matched, e)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// glossaryViolation is a paragraph whose translation doesn't use the
+// rendering required by the glossary.
+type glossaryViolation struct {
+	index int
+	entry *GlossaryEntry
+}
+
+// check returns the violations of the translated paragraphs.
+func (g *glossary) check(input []string, result []string) []*glossaryViolation {
+	var violations []*glossaryViolation
+	for idx, p := range input {
+		if idx >= len(result) {
+			break
+		}
+		for _, e := range g.entries {
+			if containsTerm(p, e.Term) && !containsTerm(result[idx], e.Rendering()) {
+				violations = append(violations, &glossaryViolation{index: idx, entry: e})
+			}
+		}
+	}
+	return violations
+}
+
+// glossaryDigest identifies the entries, so that the cached translations are
+// only invalidated by the changes of the terms in them.
+func glossaryDigest(entries []*GlossaryEntry) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\x00%s\x00", e.Term, e.Translation)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// violatesGlossary reports whether the translation of the paragraph into dest
+// doesn't use the renderings required by the glossary.
+func violatesGlossary(dest string, input string, translation string) bool {
+	g := getGlossary(dest)
+	return g != nil && len(g.check([]string{input}, []string{translation})) > 0
+}
+
+// matchGlossary returns the glossary entries of the destinations that appear
+// in the input.
+func matchGlossary(dest []string, input []string) []*GlossaryEntry {
+	var matched []*GlossaryEntry
+	for _, d := range dest {
+		if g := getGlossary(d); g != nil {
+			matched = append(matched, g.match(input)...)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,74 @@
+package translate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+func TestGlossary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zh.csv")
+	os.WriteFile(path, []byte("term,translation\nPod,容器组\nkubectl\n"), 0o644)
+	g, err := loadGlossary(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	input := []string{"Create a pod with kubectl.", "Hello world."}
+	matched := g.match(input)
+	expect := []*GlossaryEntry{{"Pod", "容器组"}, {"kubectl", ""}}
+	if !reflect.DeepEqual(matched, expect) {
+		t.Errorf("bad match, expected: %+v, actual: %+v", expect, matched)
+	}
+	if v := g.check(input, []string{"用 kubectl 创建一个容器组。", "你好世界。"}); len(v) != 0 {
+		t.Errorf("unexpected violations: %+v", v)
+	}
+	v := g.check(input, []string{"用 Kubectl 创建一个 Pod。", "你好世界。"})
+	if len(v) != 1 || v[0].index != 0 || v[0].entry.Term != "Pod" {
+		t.Errorf("bad violations: %+v", v)
+	}
+}
+
+func TestContainsTerm(t *testing.T) {
+	cases := []struct {
+		text   string
+		term   string
+		expect bool
+	}{
+		{"Written in Go.", "go", true},
+		{"a good tool", "Go", false},
+		{"a tripod", "Pod", false},
+		{"pods and Pod", "pod", true},
+		{"用Pod部署", "pod", true},
+		{"创建一个容器组。", "容器组", true},
+		{"Kubernetes 容器组网络", "容器组", true},
+		{"pi is 3.14", "3.1", false},
+	}
+	for _, c := range cases {
+		if containsTerm(c.text, c.term) != c.expect {
+			t.Errorf("containsTerm(%q, %q) should be %v", c.text, c.term, c.expect)
+		}
+	}
+}
+
+func TestHasGlossaryTerms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zh.csv")
+	os.WriteFile(path, []byte("Pod,容器组\n"), 0o644)
+	g, err := loadGlossary(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	glossaries.Store(&map[string]*glossary{glossaryKey("中文"): g})
+	config.ReadConfig().GlossaryRetries = 1
+	t.Cleanup(func() {
+		glossaries.Store(&map[string]*glossary{})
+		config.ReadConfig().GlossaryRetries = 0
+	})
+
+	s := &session{dest: []string{"中文"}, input: []string{"Create a pod.", "Hello."}}
+	if !s.hasGlossaryTerms(0) || s.hasGlossaryTerms(1) {
+		t.Errorf("only the first paragraph has the glossary terms")
+	}
+}
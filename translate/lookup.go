@@ -0,0 +1,227 @@
+package translate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+const (
+	defaultLookupMaxWords = 3
+	defaultLookupMaxChars = 40
+)
+
+var lookupTemplate = template.Must(template.New("lookup").Parse(`
+这个请求的发起时间为 {{.ReqTime}}。
+
+你是一名词典编纂者，精通各国语言，尤其是英语和中文。请帮我查询一个单词或短语，用{{index .Dest 0}}解释它{{ if gt (len .Dest) 1 }}；如果它本身就是{{index .Dest 0}}，则用{{index .Dest 1}}解释{{ end }}。{{ if .Source }}它是{{ .Source }}。{{ end }}
+
+输出要求：请输出一个 JSON 对象，"from" 写单词的语种，"to" 写释义所用的语种，语种用中文表达；"word" 是单词或短语的原形；"phonetic" 是音标，没有则留空；"senses" 是按常用程度排列的释义，每个元素的 "pos" 是词性的缩写（如 n.、v.、adj.），"meanings" 是该词性下的几个常用翻译；"examples" 是两到三个常见的例句，"text" 是原文例句，"translation" 是例句的翻译。
+
+这里给出一个输出的示例：
+	{"from":"英语","to":"中文","word":"apple","phonetic":"ˈæp(ə)l","senses":[{"pos":"n.","meanings":["苹果","苹果树"]}],"examples":[{"text":"An apple a day keeps the doctor away.","translation":"一天一苹果，医生远离我。"}]}
+
+以下是要查询的内容：
+{{- range $p := .Content }}
+{{ $p }}
+{{- end }}
+	`))
+
+// lookupSchema is the schema of the lookup output.
+var lookupSchema = &Schema{
+	Type: "object",
+	Properties: map[string]*Schema{
+		"from":     {Type: "string", Description: "单词的语种"},
+		"to":       {Type: "string", Description: "释义的语种"},
+		"word":     {Type: "string"},
+		"phonetic": {Type: "string"},
+		"senses": {
+			Type: "array",
+			Items: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"pos":      {Type: "string", Description: "词性"},
+					"meanings": {Type: "array", Items: &Schema{Type: "string"}},
+				},
+				Required: []string{"pos", "meanings"},
+			},
+		},
+		"examples": {
+			Type: "array",
+			Items: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"text":        {Type: "string"},
+					"translation": {Type: "string"},
+				},
+				Required: []string{"text", "translation"},
+			},
+		},
+	},
+	Required: []string{"from", "to", "word", "senses"},
+}
+
+// DictEntry is the result of a word lookup.
+type DictEntry struct {
+	Word     string         `json:"word"`
+	Phonetic string         `json:"phonetic,omitempty"`
+	Senses   []*DictSense   `json:"senses"`
+	Examples []*DictExample `json:"examples,omitempty"`
+}
+
+type DictSense struct {
+	// PartOfSpeech is the abbreviation, e.g. "n." or "v."
+	PartOfSpeech string   `json:"pos"`
+	Meanings     []string `json:"meanings"`
+}
+
+type DictExample struct {
+	Text        string `json:"text"`
+	Translation string `json:"translation"`
+}
+
+// Lines renders the entry as the result lines, for the clients that only
+// show the lines.
+func (e *DictEntry) Lines() []string {
+	head := e.Word
+	if e.Phonetic != "" {
+		head += " /" + strings.Trim(e.Phonetic, "/[] ") + "/"
+	}
+	lines := []string{head}
+	for _, s := range e.Senses {
+		lines = append(lines, strings.TrimSpace(s.PartOfSpeech+" "+strings.Join(s.Meanings, "；")))
+	}
+	for _, ex := range e.Examples {
+		lines = append(lines, fmt.Sprintf("例：%s —— %s", ex.Text, ex.Translation))
+	}
+	return lines
+}
+
+type lookupResp struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	DictEntry
+}
+
+// IsLookup reports whether the text is a word or a short phrase to look up,
+// by the "lookup" config.
+func IsLookup(text string) bool {
+	cfg := config.ReadConfig().Lookup
+	if !cfg.Enabled {
+		return false
+	}
+	maxWords := cfg.MaxWords
+	if maxWords <= 0 {
+		maxWords = defaultLookupMaxWords
+	}
+	maxChars := cfg.MaxChars
+	if maxChars <= 0 {
+		maxChars = defaultLookupMaxChars
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || strings.Contains(text, "\n") || utf8.RuneCountInString(text) > maxChars {
+		return false
+	}
+	// a sentence
+	if strings.ContainsAny(text, ".!?。！？,，;；") && !strings.HasSuffix(text, ".") {
+		return false
+	}
+	words := 0
+	for _, f := range strings.Fields(text) {
+		cjk, other := 0, false
+		for _, r := range f {
+			if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+				cjk++
+			} else if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				other = true
+			}
+		}
+		// two CJK characters count as a word
+		words += (cjk + 1) / 2
+		if other {
+			words++
+		}
+	}
+	return words > 0 && words <= maxWords
+}
+
+// Lookup looks up the word or phrase in req.Text like a dictionary. The
+// result lines are rendered from the entry, which is also set in Dict.
+func Lookup(ctx context.Context, req *TranslateReq) (*TranslateResp, error) {
+	select {
+	case id := <-sem:
+		defer func() {
+			sem <- id
+		}()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	backend, err := getBackend()
+	if err != nil {
+		return nil, err
+	}
+	word := strings.TrimSpace(req.Text)
+	s := newSession(ctx, req.Destination, []string{word}, nil, sessionOptions{
+		endpoint: EndpointHcfy,
+		source:   req.Source,
+	})
+	s.resolveLanguage()
+
+	out := bytes.NewBuffer(nil)
+	err = getTemplate(promptLookup).Execute(out, &promptData{
+		ReqTime: time.Now().String(),
+		Dest:    s.dest,
+		Source:  s.source,
+		Content: s.input,
+		JSON:    true,
+		Vars:    config.ReadConfig().PromptVars,
+	})
+	if err != nil {
+		log.Errorf("failed to render prompt: %s", err)
+		return nil, err
+	}
+	backendReq := &BackendRequest{
+		Prompt:     out.String(),
+		Generation: config.GetGenerationConfig(EndpointHcfy),
+	}
+	if sb, ok := backend.(SchemaBackend); ok && sb.SupportsSchema("") {
+		backendReq.ResponseSchema = lookupSchema
+	}
+	attemptCtx, cancel := attemptContext(ctx)
+	defer cancel()
+	resp, err := backend.Generate(attemptCtx, backendReq)
+	if err != nil {
+		log.Errorf("backend err: %T \"%s\"", err, err.Error())
+		return nil, err
+	}
+	log.Debugf("lookup answer: %s", resp.Text)
+
+	parsed := &lookupResp{}
+	if err := json.Unmarshal([]byte(stripCodeFence(resp.Text)), parsed); err != nil {
+		return nil, fmt.Errorf("invalid lookup result: %w", err)
+	}
+	if len(parsed.Senses) == 0 {
+		return nil, fmt.Errorf("invalid lookup result: no senses")
+	}
+	if parsed.Word == "" {
+		parsed.Word = word
+	}
+	result := &TranslateResp{
+		Text:   req.Text,
+		From:   parsed.From,
+		To:     parsed.To,
+		Result: parsed.Lines(),
+		Dict:   &parsed.DictEntry,
+	}
+	s.settleLanguages(result)
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package translate
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+func TestIsLookup(t *testing.T) {
+	config.ReadConfig().Lookup = config.LookupConfig{Enabled: true}
+	t.Cleanup(func() {
+		config.ReadConfig().Lookup = config.LookupConfig{}
+	})
+	cases := map[string]bool{
+		"apple":                   true,
+		"take off":                true,
+		"苹果":                      true,
+		"e.g.":                    true,
+		"a piece of cake":         false,
+		"Hello, world":            false,
+		"我今天去了学校":                 false,
+		"first line\nsecond line": false,
+		"supercalifragilisticexpialidocious and more": false,
+	}
+	for text, expect := range cases {
+		if actual := IsLookup(text); actual != expect {
+			t.Errorf("bad IsLookup of %q, expected: %v, actual: %v", text, expect, actual)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	fake := useFakeBackend(t)
+	fake.answer = "```json\n" + `{"from":"英语","to":"中文","word":"apple","phonetic":"ˈæp(ə)l",` +
+		`"senses":[{"pos":"n.","meanings":["苹果","苹果树"]}],` +
+		`"examples":[{"text":"I like apples.","translation":"我喜欢苹果。"}]}` + "\n```"
+	resp, err := Lookup(context.Background(), &TranslateReq{
+		Text:        "apple",
+		Destination: []string{"中文(简体)", "英语"},
+		Source:      "en",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expect := []string{"apple /ˈæp(ə)l/", "n. 苹果；苹果树", "例：I like apples. —— 我喜欢苹果。"}
+	if !reflect.DeepEqual(resp.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, resp.Result)
+	}
+	if resp.Dict == nil || resp.Dict.Word != "apple" || resp.From != "英语" || resp.To != "中文(简体)" {
+		t.Errorf("bad response: %+v", resp)
+	}
+	if !strings.Contains(fake.prompts[0], "apple") {
+		t.Errorf("the word is not in the prompt: %s", fake.prompts[0])
+	}
+}
@@ -0,0 +1,95 @@
+package translate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// markupPattern matches the spans that should not be translated. For the
+	// markdown links and images, only the brackets and the url are protected,
+	// the text inside is translated.
+	markupPattern = regexp.MustCompile(strings.Join([]string{
+		"```[^`]*```",
+		"``[^`]*``",
+		"`[^`\n]+`",
+		`<Keep This Symbol>`,
+		`</?[a-zA-Z][a-zA-Z0-9-]*(?:\s[^<>]*)?/?>`,
+		`&(?:[a-zA-Z]+|#\d+|#x[0-9a-fA-F]+);`,
+		`!?\[`,
+		`\]\([^()\s]+(?:\s+"[^"]*")?\)`,
+		`https?://[^\s<>()\[\]]+`,
+	}, "|"))
+	placeholderPattern = regexp.MustCompile(`⟦(\d+)⟧`)
+)
+
+func placeholderOf(id int) string {
+	return fmt.Sprintf("⟦%d⟧", id)
+}
+
+// protectedText is a paragraph whose markup is replaced by the placeholders.
+type protectedText struct {
+	text string
+	// spans are the original markup, indexed by the placeholder id
+	spans []string
+}
+
+// protect replaces the markup and the code spans in p with the placeholders.
+// A "[" is only protected if it starts a markdown link, so that a bracket in
+// the plain text is left alone.
+func protect(p string) *protectedText {
+	pt := &protectedText{}
+	var b strings.Builder
+	last := 0
+	matches := markupPattern.FindAllStringIndex(p, -1)
+	for i, m := range matches {
+		span := p[m[0]:m[1]]
+		if strings.HasSuffix(span, "[") && !closedLink(p, matches[i+1:]) {
+			continue
+		}
+		if span[0] == ']' && (len(pt.spans) == 0 || !strings.HasSuffix(pt.spans[len(pt.spans)-1], "[")) {
+			// the opening bracket was not protected
+			continue
+		}
+		b.WriteString(p[last:m[0]])
+		b.WriteString(placeholderOf(len(pt.spans)))
+		pt.spans = append(pt.spans, span)
+		last = m[1]
+	}
+	b.WriteString(p[last:])
+	pt.text = b.String()
+	return pt
+}
+
+// closedLink reports whether the next match after an opening bracket is the
+// closing part of a markdown link.
+func closedLink(p string, rest [][]int) bool {
+	return len(rest) > 0 && p[rest[0][0]] == ']'
+}
+
+// restore puts the markup back into the translation of the paragraph.
+func (pt *protectedText) restore(translated string) string {
+	if len(pt.spans) == 0 {
+		return translated
+	}
+	return placeholderPattern.ReplaceAllStringFunc(translated, func(s string) string {
+		id, _ := strconv.Atoi(s[len("⟦") : len(s)-len("⟧")])
+		if id < len(pt.spans) {
+			return pt.spans[id]
+		}
+		return s
+	})
+}
+
+// lostPlaceholder reports whether any placeholder of the input is missing
+// from the translation.
+func lostPlaceholder(input string, translated string) bool {
+	for _, m := range placeholderPattern.FindAllString(input, -1) {
+		if !strings.Contains(translated, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package translate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProtect(t *testing.T) {
+	cases := []struct {
+		input string
+		text  string
+		spans []string
+	}{
+		{
+			"Run `go build` and see <b>the docs</b>",
+			"Run ⟦0⟧ and see ⟦1⟧the docs⟦2⟧",
+			[]string{"`go build`", "<b>", "</b>"},
+		},
+		{
+			"Read [the guide](https://example.com/guide) first",
+			"Read ⟦0⟧the guide⟦1⟧ first",
+			[]string{"[", "](https://example.com/guide)"},
+		},
+		{
+			"a [note] and a < b",
+			"a [note] and a < b",
+			nil,
+		},
+		{
+			"foo<Keep This Symbol>bar &amp; baz",
+			"foo⟦0⟧bar ⟦1⟧ baz",
+			[]string{"<Keep This Symbol>", "&amp;"},
+		},
+	}
+	for _, c := range cases {
+		pt := protect(c.input)
+		if pt.text != c.text || !reflect.DeepEqual(pt.spans, c.spans) {
+			t.Errorf("bad protection of %q, text: %q, spans: %q", c.input, pt.text, pt.spans)
+		}
+		if actual := pt.restore(pt.text); actual != c.input {
+			t.Errorf("bad restore, expected: %q, actual: %q", c.input, actual)
+		}
+	}
+
+	pt := protect("Read [the guide](https://example.com/guide) first")
+	if actual := pt.restore("先读⟦0⟧指南⟦1⟧"); actual != "先读[指南](https://example.com/guide)" {
+		t.Errorf("bad restore: %q", actual)
+	}
+	if !lostPlaceholder(pt.text, "先读指南⟦1⟧") || lostPlaceholder(pt.text, "⟦1⟧⟦0⟧") {
+		t.Errorf("bad lostPlaceholder")
+	}
+}
@@ -0,0 +1,154 @@
+package translate
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+const (
+	promptSingleDest = "single_dest"
+	promptMultiDest  = "multi_dest"
+	promptAllDest    = "all_dest"
+	promptLookup     = "lookup"
+)
+
+// promptData is the data model of the prompt templates.
+type promptData struct {
+	ReqTime string
+	Dest    []string
+	// Source is the language of the content, empty if unknown
+	Source  string
+	Content []string
+	// JSON is true if the structured output is requested
+	JSON bool
+	// Placeholders is true if the content has the placeholders of the
+	// protected markup
+	Placeholders bool
+	// Vars are the custom variables from "prompt_vars" in config.json
+	Vars map[string]string
+	// Glossary is the glossary entries that appear in the content
+	Glossary []*GlossaryEntry
+	// Groups are the content grouped by the destinations, only for the
+	// all_dest template
+	Groups []*promptGroup
+}
+
+// promptGroup is the content to translate into a destination.
+type promptGroup struct {
+	Dest     string
+	Content  []string
+	Glossary []*GlossaryEntry
+}
+
+var (
+	builtinTemplates = map[string]*template.Template{
+		promptSingleDest: singleDestTemplate,
+		promptMultiDest:  multiDestTemplate,
+		promptAllDest:    allDestTemplate,
+		promptLookup:     lookupTemplate,
+	}
+	templates atomic.Pointer[map[string]*template.Template]
+)
+
+func init() {
+	templates.Store(&builtinTemplates)
+	config.AddConfigChangeCallback(loadPrompts)
+}
+
+func getTemplate(name string) *template.Template {
+	return (*templates.Load())[name]
+}
+
+// loadPrompts loads the templates named in "prompts" of config.json, the
+// builtin templates are used for the missing or invalid ones.
+func loadPrompts() {
+	loaded := make(map[string]*template.Template, len(builtinTemplates))
+	for name, tmpl := range builtinTemplates {
+		loaded[name] = tmpl
+	}
+	for name, path := range config.ReadConfig().Prompts {
+		if _, ok := builtinTemplates[name]; !ok {
+			log.Errorf("unknown prompt template %q", name)
+			continue
+		}
+		tmpl, err := loadPrompt(name, path)
+		if err != nil {
+			log.Errorf("failed to load prompt template %q from %s, err: %s", name, path, err)
+			if old := getTemplate(name); old != nil {
+				loaded[name] = old
+			}
+			continue
+		}
+		log.Infof("loaded prompt template %q from %s", name, path)
+		loaded[name] = tmpl
+	}
+	templates.Store(&loaded)
+}
+
+func loadPrompt(name string, path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePrompt(tmpl); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// validatePrompt renders the template with sample data, and makes sure that
+// the content to translate is included.
+func validatePrompt(tmpl *template.Template) error {
+	vars := config.ReadConfig().PromptVars
+	for _, jsonMode := range []bool{false, true} {
+		sample := &promptData{
+			ReqTime: "2006-01-02 15:04:05",
+			Dest:    []string{"中文", "英语"},
+			Content: []string{"<sample paragraph 1>", "<sample paragraph 2>"},
+			JSON:    jsonMode,
+			Vars:    vars,
+		}
+		sample.Groups = []*promptGroup{
+			{Dest: "中文", Content: sample.Content[:1]},
+			{Dest: "英语", Content: sample.Content[1:]},
+		}
+		out := bytes.NewBuffer(nil)
+		if err := tmpl.Execute(out, sample); err != nil {
+			return err
+		}
+		for _, c := range sample.Content {
+			if !strings.Contains(out.String(), c) {
+				return fmt.Errorf("the content to translate is not rendered")
+			}
+		}
+	}
+	return nil
+}
+
+// promptSource returns the source of all the templates in use.
+func promptSource() string {
+	current := *templates.Load()
+	var names []string
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteString(current[name].Tree.Root.String())
+	}
+	return b.String()
+}
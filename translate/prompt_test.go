@@ -0,0 +1,31 @@
+package translate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPrompt(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.tmpl")
+	os.WriteFile(good, []byte(`Translate into {{index .Dest 0}}:
+{{- range .Content }}
+{{ . }}
+{{- end }}`), 0o644)
+	if _, err := loadPrompt(promptSingleDest, good); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	noContent := filepath.Join(dir, "no_content.tmpl")
+	os.WriteFile(noContent, []byte(`Translate into {{index .Dest 0}}`), 0o644)
+	if _, err := loadPrompt(promptSingleDest, noContent); err == nil {
+		t.Errorf("expect error for the template without content")
+	}
+
+	badField := filepath.Join(dir, "bad_field.tmpl")
+	os.WriteFile(badField, []byte(`{{ .Vars.tone }} {{ .Content }}`), 0o644)
+	if _, err := loadPrompt(promptSingleDest, badField); err == nil {
+		t.Errorf("expect error for the missing variable")
+	}
+}
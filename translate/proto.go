@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/zjx20/hcfy-gemini/config"
 )
 
 // https://hcfy.app/docs/services/custom-api
@@ -13,14 +15,22 @@ type TranslateReq struct {
 	Text        string   `json:"text"`
 	Destination []string `json:"destination"`
 	Source      string   `json:"source"`
+	// AllDestinations asks for the translations into every destination,
+	// instead of the first one (or the second if the text is already in the
+	// first one)
+	AllDestinations bool `json:"all_destinations,omitempty"`
+}
+
+func (req *TranslateReq) allDestinations() bool {
+	return len(req.Destination) > 1 && (req.AllDestinations || config.ReadConfig().AllDestinations)
 }
 
 func (req *TranslateReq) Bind(r *http.Request) error {
 	if len(req.Destination) == 0 {
 		return fmt.Errorf("destination should not be empty")
 	}
-	req.Text = strings.TrimSpace(req.Text)
-	if req.Text == "" {
+	// the whitespace is kept for the layout
+	if strings.TrimSpace(req.Text) == "" {
 		return fmt.Errorf("text should not be empty")
 	}
 	return nil
@@ -31,4 +41,14 @@ type TranslateResp struct {
 	From   string   `json:"from"`
 	To     string   `json:"to"`
 	Result []string `json:"result"`
+	// Dict is set if the text is looked up as a word
+	Dict *DictEntry `json:"dict,omitempty"`
+	// Translations are the results grouped by the destinations, if all the
+	// destinations are requested
+	Translations []*DestTranslation `json:"translations,omitempty"`
+}
+
+type DestTranslation struct {
+	To     string   `json:"to"`
+	Result []string `json:"result"`
 }
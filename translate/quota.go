@@ -0,0 +1,60 @@
+package translate
+
+import (
+	"time"
+
+	"github.com/zjx20/hcfy-gemini/config"
+	"github.com/zjx20/hcfy-gemini/util/tokenbucket"
+)
+
+// consumptionRules returns the rules for a bucket with rpm tokens, the
+// thresholds are scaled from the original rules for 60 rpm.
+func consumptionRules(rpm int) []tokenbucket.ConsumptionRule {
+	return []tokenbucket.ConsumptionRule{
+		{
+			RestThreshold: rpm * 40 / 60,
+			Wait:          0,
+			RuleID:        1,
+		},
+		{
+			RestThreshold: rpm * 30 / 60,
+			Wait:          100 * time.Millisecond,
+			RuleID:        2,
+		},
+		{
+			RestThreshold: rpm * 20 / 60,
+			Wait:          500 * time.Millisecond,
+			RuleID:        3,
+		},
+		{
+			RestThreshold: rpm * 10 / 60,
+			Wait:          2000 * time.Millisecond,
+			RuleID:        4,
+		},
+		{
+			RestThreshold: 0,
+			Wait:          3000 * time.Millisecond,
+			RuleID:        5,
+		},
+	}
+}
+
+// NewTokenBucket creates a token bucket sized by the total quota of all the
+// API keys. The bucket is resized when the config changes.
+func NewTokenBucket() *tokenbucket.AdaptiveTokenBucket {
+	rpm := config.GetTotalRPM()
+	bucket := tokenbucket.NewAdaptiveTokenBucket(rpm, rpm,
+		tokenbucket.ProductionRule{
+			Interval:  1 * time.Minute,
+			Increment: rpm,
+		},
+		consumptionRules(rpm),
+	)
+	config.AddConfigChangeCallback(func() {
+		if newRPM := config.GetTotalRPM(); newRPM != rpm {
+			rpm = newRPM
+			bucket.Resize(rpm, rpm, consumptionRules(rpm))
+		}
+	})
+	return bucket
+}
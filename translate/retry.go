@@ -0,0 +1,129 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+type ErrorClass int
+
+const (
+	// ErrRetryable is a transient error, e.g. a 503 or a broken response
+	ErrRetryable ErrorClass = iota
+	// ErrRateLimited means the quota is exhausted for now
+	ErrRateLimited
+	// ErrFatal won't go away by retrying, e.g. an invalid API key or a
+	// safety block
+	ErrFatal
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrRetryable:
+		return "retryable"
+	case ErrRateLimited:
+		return "rate limited"
+	case ErrFatal:
+		return "fatal"
+	}
+	return fmt.Sprintf("ErrorClass(%d)", int(c))
+}
+
+// BackendError is an error classified by the backend.
+type BackendError struct {
+	Class ErrorClass
+	// RetryAfter is the delay suggested by the server, zero if unknown
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *BackendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Classify returns the class of err and the delay suggested by the server.
+// Errors not classified by the backend are treated as retryable.
+func Classify(err error) (ErrorClass, time.Duration) {
+	var be *BackendError
+	if errors.As(err, &be) {
+		return be.Class, be.RetryAfter
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrFatal, 0
+	}
+	return ErrRetryable, 0
+}
+
+const (
+	defaultMaxAttempts = 5
+	defaultBaseDelay   = 500 * time.Millisecond
+	defaultMaxDelay    = 30 * time.Second
+)
+
+// RetryDelay decides whether to retry after the attempt-th failure (starting
+// from 1) with err, and how long to wait before the next attempt. The delay
+// grows exponentially with jitter, and honors the delay suggested by the
+// server.
+func RetryDelay(err error, attempt int) (time.Duration, bool) {
+	cfg := config.ReadConfig().Retry
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	class, retryAfter := Classify(err)
+	if class == ErrFatal || attempt >= maxAttempts {
+		return 0, false
+	}
+	base := time.Duration(cfg.BaseDelay) * time.Millisecond
+	if base <= 0 {
+		base = defaultBaseDelay
+	}
+	maxDelay := time.Duration(cfg.MaxDelay) * time.Millisecond
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxDelay
+	}
+	delay := base << (attempt - 1)
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+	if class == ErrRateLimited && delay < maxDelay/2 {
+		// the quota won't be back soon
+		delay = maxDelay / 2
+	}
+	// full jitter in [delay/2, delay)
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay, true
+}
+
+// attemptContext limits a single call to the backend by the "attempt_timeout"
+// config.
+func attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := config.ReadConfig().Retry.AttemptTimeout; timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Sleep waits for d, returns false if ctx is done before that.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
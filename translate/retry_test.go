@@ -0,0 +1,38 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zjx20/hcfy-gemini/gemini"
+)
+
+func TestRetryDelay(t *testing.T) {
+	fatal := &BackendError{Class: ErrFatal, Err: errors.New("blocked")}
+	if _, retry := RetryDelay(fmt.Errorf("wrapped: %w", fatal), 1); retry {
+		t.Errorf("fatal error should not be retried")
+	}
+	if _, retry := RetryDelay(context.Canceled, 1); retry {
+		t.Errorf("canceled error should not be retried")
+	}
+	if _, retry := RetryDelay(errors.New("eof"), defaultMaxAttempts); retry {
+		t.Errorf("should give up after %d attempts", defaultMaxAttempts)
+	}
+	for attempt := 1; attempt < defaultMaxAttempts; attempt++ {
+		delay, retry := RetryDelay(errors.New("eof"), attempt)
+		if !retry || delay > defaultMaxDelay {
+			t.Errorf("attempt %d: unexpected delay %s, retry %v", attempt, delay, retry)
+		}
+	}
+	limited := &BackendError{Class: ErrRateLimited, RetryAfter: time.Minute, Err: errors.New("429")}
+	if delay, retry := RetryDelay(limited, 1); !retry || delay != time.Minute {
+		t.Errorf("expect to honor retry after, got %s, retry %v", delay, retry)
+	}
+	exhausted := classifyGeminiError(&gemini.KeysExhaustedError{RetryAfter: time.Minute})
+	if delay, retry := RetryDelay(exhausted, 1); !retry || delay != time.Minute {
+		t.Errorf("expect to wait for the keys, got %s, retry %v", delay, retry)
+	}
+}
@@ -0,0 +1,49 @@
+package translate
+
+import (
+	"regexp"
+	"strings"
+)
+
+// segmentPattern splits a line into the leading whitespace with the list
+// marker, the content, and the trailing whitespace.
+var segmentPattern = regexp.MustCompile(`^(\s*(?:(?:[-*+•·▪◦]|\d{1,3}[.)]|\(\d{1,3}\))\s+)?)(.*?)(\s*)$`)
+
+// Segment is a line of the text, with the layout around the content kept
+// aside, so that only the content is translated.
+type Segment struct {
+	// Prefix is the indentation and the list marker, e.g. "  - "
+	Prefix  string
+	Content string
+	// Suffix is the trailing whitespace
+	Suffix string
+}
+
+// SplitSegments splits the text into lines, a blank line is a segment with
+// empty content.
+func SplitSegments(text string) []*Segment {
+	lines := strings.Split(text, "\n")
+	segs := make([]*Segment, len(lines))
+	for i, line := range lines {
+		m := segmentPattern.FindStringSubmatch(line)
+		segs[i] = &Segment{Prefix: m[1], Content: m[2], Suffix: m[3]}
+	}
+	return segs
+}
+
+// Blank reports whether there is nothing to translate in the segment.
+func (s *Segment) Blank() bool {
+	return s.Content == ""
+}
+
+// Apply puts the translated content back into the layout of the segment.
+func (s *Segment) Apply(translated string) string {
+	translated = strings.TrimSpace(translated)
+	// the model may copy the list marker
+	if marker := strings.TrimSpace(s.Prefix); marker != "" {
+		if rest, ok := strings.CutPrefix(translated, marker+" "); ok {
+			translated = strings.TrimSpace(rest)
+		}
+	}
+	return s.Prefix + translated + s.Suffix
+}
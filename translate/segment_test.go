@@ -0,0 +1,34 @@
+package translate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSegments(t *testing.T) {
+	segs := SplitSegments("Title\n\n  - first item  \n\t2. second\r\n   \n(3) third\n-5 degrees")
+	expect := []*Segment{
+		{"", "Title", ""},
+		{"", "", ""},
+		{"  - ", "first item", "  "},
+		{"\t2. ", "second", "\r"},
+		{"   ", "", ""},
+		{"(3) ", "third", ""},
+		{"", "-5 degrees", ""},
+	}
+	if !reflect.DeepEqual(segs, expect) {
+		for i := range segs {
+			t.Logf("%d: %+v", i, segs[i])
+		}
+		t.Fatalf("bad segments")
+	}
+	if actual := segs[2].Apply("第一项"); actual != "  - 第一项  " {
+		t.Errorf("bad layout: %q", actual)
+	}
+	if actual := segs[2].Apply("- 第一项"); actual != "  - 第一项  " {
+		t.Errorf("the copied list marker should be removed: %q", actual)
+	}
+	if actual := segs[4].Apply(""); actual != "   " {
+		t.Errorf("blank line should be kept: %q", actual)
+	}
+}
@@ -0,0 +1,59 @@
+package translate
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sentenceEnd matches the end of a sentence with the closing quotes and the
+// whitespace after it. The ASCII terminators must be followed by whitespace
+// or the end of the text, so "3.14" and "example.com" are not split.
+var sentenceEnd = regexp.MustCompile(`[.!?;…]+["'”’」』)）]*(?:\s+|$)|[。！？；]+["'”’」』)）]*\s*`)
+
+// splitSentences splits the paragraph at the sentence boundaries, and packs
+// the sentences into pieces whose output fits in the budget. A sentence
+// larger than the budget is a piece by itself.
+func splitSentences(p string, budget int) []string {
+	var sentences []string
+	last := 0
+	for _, loc := range sentenceEnd.FindAllStringIndex(p, -1) {
+		sentences = append(sentences, p[last:loc[1]])
+		last = loc[1]
+	}
+	if last < len(p) {
+		sentences = append(sentences, p[last:])
+	}
+	var pieces []string
+	cur := ""
+	for _, s := range sentences {
+		if cur != "" && outputTokens(cur+s) > budget {
+			pieces = append(pieces, strings.TrimSpace(cur))
+			cur = ""
+		}
+		cur += s
+	}
+	if strings.TrimSpace(cur) != "" {
+		pieces = append(pieces, strings.TrimSpace(cur))
+	}
+	return pieces
+}
+
+// joinPieces joins the translated pieces of a paragraph. They are separated
+// by a space, unless the previous one ends with a CJK character or a
+// full-width punctuation.
+func joinPieces(pieces []string) string {
+	var b strings.Builder
+	for i, p := range pieces {
+		if i > 0 && b.Len() > 0 {
+			r, _ := utf8.DecodeLastRuneInString(b.String())
+			if !unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) &&
+				!(r >= 0x3000 && r <= 0x303f) && !(r >= 0xff00 && r <= 0xffef) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
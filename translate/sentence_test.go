@@ -0,0 +1,93 @@
+package translate
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+func TestSplitSentences(t *testing.T) {
+	p := "First one. Second one! Third one? 第四句。第五句"
+	pieces := splitSentences(p, 1)
+	expect := []string{"First one.", "Second one!", "Third one?", "第四句。", "第五句"}
+	if !reflect.DeepEqual(pieces, expect) {
+		t.Errorf("bad pieces, expected: %q, actual: %q", expect, pieces)
+	}
+	if pieces := splitSentences(p, 1000); !reflect.DeepEqual(pieces, []string{p}) {
+		t.Errorf("the paragraph should be kept in a piece: %q", pieces)
+	}
+	p = "Pi is 3.14 here. See example.com now!Not yet... Done"
+	expect = []string{"Pi is 3.14 here.", "See example.com now!Not yet...", "Done"}
+	if pieces := splitSentences(p, 1); !reflect.DeepEqual(pieces, expect) {
+		t.Errorf("bad pieces, expected: %q, actual: %q", expect, pieces)
+	}
+	if actual := joinPieces([]string{"One.", "Two.", "三。", "四。"}); actual != "One. Two. 三。四。" {
+		t.Errorf("bad join: %q", actual)
+	}
+}
+
+func TestLongParagraph(t *testing.T) {
+	fake := useFakeBackend(t)
+	config.ReadConfig().Tokens.MaxOutputTokens = 60
+	t.Cleanup(func() {
+		config.ReadConfig().Tokens.MaxOutputTokens = 0
+	})
+	long := strings.Repeat("This is a sentence. ", 4) + "The end."
+	ch := make(chan *TranslateResult, 1)
+	Translate2(context.Background(), []string{"short", long}, "中文", ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	expect := []string{"SHORT", strings.ToUpper(strings.TrimSpace(long))}
+	if !reflect.DeepEqual(result.Resp.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, result.Resp.Result)
+	}
+	if len(fake.inputs) < 2 {
+		t.Errorf("the long paragraph should be split: %q", fake.inputs)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	fake := useFakeBackend(t)
+	fake.truncate = func(input []string) bool {
+		return len(input) > 1
+	}
+	ch := make(chan *TranslateResult, 1)
+	Translate2(context.Background(), []string{"a", "b", "c"}, "中文", ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if expect := []string{"A", "B", "C"}; !reflect.DeepEqual(result.Resp.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, result.Resp.Result)
+	}
+	expect := [][]string{{"a", "b", "c"}, {"a"}, {"b", "c"}, {"b"}, {"c"}}
+	if !reflect.DeepEqual(fake.inputs, expect) {
+		t.Errorf("the truncated batch should be requested in halves, expected: %q, actual: %q",
+			expect, fake.inputs)
+	}
+}
+
+func TestTruncatedParagraph(t *testing.T) {
+	fake := useFakeBackend(t)
+	fake.truncate = func(input []string) bool {
+		return len(strings.Join(input, "")) > 40
+	}
+	long := "The first sentence is here. The second sentence is here. The last one is here."
+	ch := make(chan *TranslateResult, 1)
+	Translate2(context.Background(), []string{long}, "中文", ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if expect := []string{strings.ToUpper(long)}; !reflect.DeepEqual(result.Resp.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, result.Resp.Result)
+	}
+	if len(fake.inputs) < 3 {
+		t.Errorf("the truncated paragraph should be requested in pieces: %q", fake.inputs)
+	}
+}
@@ -3,62 +3,85 @@ package translate
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zjx20/hcfy-gemini/config"
-	"github.com/zjx20/hcfy-gemini/gemini"
+	"github.com/zjx20/hcfy-gemini/util/lang"
 )
 
 var (
-	resultPattern = regexp.MustCompile(`(?ms)\s*(.*?)->(.*?)\n\s*(.*?)\z`)
-	beginMarker   = "----begin----"
-	endMarker     = "----end----"
+	headerPattern = regexp.MustCompile(`^\s*(.+?)\s*->\s*(.+?)\s*$`)
+	beginPattern  = regexp.MustCompile(`----begin(?:[ \t]*#?(\d+))?[ \t]*----`)
+	endPattern    = regexp.MustCompile(`----end(?:[ \t]*#?\d+)?[ \t]*----`)
 
 	singleDestTemplate = template.Must(template.New("single_dest").Parse(`
 这个请求的发起时间为 {{.ReqTime}}。
 
 你是一名翻译员，精通各国语言，尤其是英语和中文；同时你也精通各种计算机技术，习惯在 github 或 stackoverflow 等网站发表专业评论。
 请帮我完成一些翻译，我现在会描述输入和输出的规则，真正需要翻译的内容我会在末尾给出。
+{{ if .JSON }}
+输入要求：每个段落是一个 JSON 对象，占一行，"id" 是段落的编号，"text" 是段落的内容；可能存在多个段落，段落之间的内容是相互独立的，不要混在一起翻译。
 
-输入要求：待翻译的内容被特殊标记包裹，每个段落以 "----begin----" 开始，以 "----end----" 结尾；可能存在多个段落，段落之间的内容是相互独立的，不要混在一起翻译。
+输出要求：请输出一个 JSON 对象，"from" 写从哪个语种翻译，"to" 写翻译到哪个语种，语种用中文表达；"paragraphs" 是每段的翻译，每个元素的 "id" 与输入段落的 "id" 对应，"text" 是翻译后的内容。
+{{- else }}
+输入要求：待翻译的内容被特殊标记包裹，每个段落以 "----begin N----" 开始，以 "----end N----" 结尾，N 是段落的编号；可能存在多个段落，段落之间的内容是相互独立的，不要混在一起翻译。
 
-输出要求：请按格式输出翻译结果，输出的第一行首先写从哪个语种翻译到哪个语种，格式为 "{source} -> {destination}"，语种用中文表达；紧接着输出每段的翻译，同样用 "----begin----" 和 "----end----" 包裹。
-
-翻译要求：请把内容翻译成{{index .Dest 0}}，采用意译的翻译手法，含义准确，使用常见的单词和简练的句式，符合母语人士的表达习惯。必要时可以采用多阶段翻译，例如先直译一遍，然后在直译的基础上适当调整文法表达，或根据内容含义重新组织输出，最后再做一次精炼。每个段落独立翻译，每个段落都要有对应的翻译输出，即输入有多少段，输出就要有多少段。
+输出要求：请按格式输出翻译结果，输出的第一行首先写从哪个语种翻译到哪个语种，格式为 "{source} -> {destination}"，语种用中文表达；紧接着输出每段的翻译，同样用 "----begin N----" 和 "----end N----" 包裹，N 与输入段落的编号保持一致。
+{{- end }}
 
+翻译要求：{{ if .Source }}原文是{{ .Source }}，{{ end }}请把内容翻译成{{index .Dest 0}}，采用意译的翻译手法，含义准确，使用常见的单词和简练的句式，符合母语人士的表达习惯。必要时可以采用多阶段翻译，例如先直译一遍，然后在直译的基础上适当调整文法表达，或根据内容含义重新组织输出，最后再做一次精炼。每个段落独立翻译，每个段落都要有对应的翻译输出，即输入有多少段，输出就要有多少段。
+{{ if .Glossary }}
+术语要求：以下术语请严格按照术语表翻译，"保持原文" 表示该术语不要翻译，原样输出。
+{{- range .Glossary }}
+	{{ .Term }} => {{ if .Translation }}{{ .Translation }}{{ else }}保持原文{{ end }}
+{{- end }}
+{{ end }}
 另外请注意，有些段落可能整段都是一些无意义的 unicode 字符，这些内容可以直接输出，跳过翻译。
+{{- if .Placeholders }}
+段落中形如 ⟦0⟧ 的标记是占位符，代表不需要翻译的代码或格式，请在译文的对应位置原样保留每一个占位符，不要修改、删除或增加占位符。
+{{- end }}
 
 这里给出一个输入输出的示例：
+{{ if .JSON }}
+	输入：
+	{"id":0,"text":"hello"}
+	{"id":1,"text":"world"}
+	{"id":2,"text":"►"}
 
+	输出：
+	{"from":"英语","to":"中文","paragraphs":[{"id":0,"text":"你好"},{"id":1,"text":"世界"},{"id":2,"text":"►"}]}
+{{ else }}
 	输入：
-	----begin----
+	----begin 0----
 	hello
-	----end----
-	----begin----
+	----end 0----
+	----begin 1----
 	world
-	----end----
-	----begin----
+	----end 1----
+	----begin 2----
 	►
-	----end----
+	----end 2----
 
 	输出：
 	英语 -> 中文
-	----begin----
+	----begin 0----
 	你好
-	----end----
-	----begin----
+	----end 0----
+	----begin 1----
 	世界
-	----end----
-	----begin----
+	----end 1----
+	----begin 2----
 	►
-	----end----
-
+	----end 2----
+{{ end }}
 再强调一遍，输出的段落数目要和输入一样，顺序也要跟输入一致。
 
 以下是待翻译内容，请输出翻译后的内容，共有{{ len .Content }}个段落：
@@ -72,65 +95,189 @@ var (
 
 你是一名翻译员，精通各国语言，尤其是英语和中文；同时你也精通各种计算机技术，习惯在 github 或 stackoverflow 等网站发表专业评论。
 请帮我完成一些翻译，我现在会描述输入和输出的规则，真正需要翻译的内容我会在末尾给出。
+{{ if .JSON }}
+输入要求：每个段落是一个 JSON 对象，占一行，"id" 是段落的编号，"text" 是段落的内容；可能存在多个段落，段落之间的内容是相互独立的，不要混在一起翻译。
 
-输入要求：待翻译的内容被特殊标记包裹，每个段落以 "----begin----" 开始，以 "----end----" 结尾；可能存在多个段落，段落之间的内容是相互独立的，不要混在一起翻译。
+输出要求：请输出一个 JSON 对象，"from" 写从哪个语种翻译，"to" 写翻译到哪个语种，语种用中文表达；"paragraphs" 是每段的翻译，每个元素的 "id" 与输入段落的 "id" 对应，"text" 是翻译后的内容。
+{{- else }}
+输入要求：待翻译的内容被特殊标记包裹，每个段落以 "----begin N----" 开始，以 "----end N----" 结尾，N 是段落的编号；可能存在多个段落，段落之间的内容是相互独立的，不要混在一起翻译。
 
-输出要求：请按格式输出翻译结果，输出的第一行首先写从哪个语种翻译到哪个语种，格式为 "{source} -> {destination}"，语种用中文表达；紧接着输出每段的翻译，同样用 "----begin----" 和 "----end----" 包裹。
-
-翻译要求：请把内容翻译成{{index .Dest 0}}。如果它已经是{{index .Dest 0}}，则把它翻译成{{index .Dest 1}}。采用意译的翻译手法，含义准确，使用常见的单词和简练的句式，符合母语人士的表达习惯。必要时可以采用多阶段翻译，例如先直译一遍，然后在直译的基础上适当调整文法表达，或根据内容含义重新组织输出，最后再做一次精炼。每个段落独立翻译，每个段落都要有对应的翻译输出，即输入有多少段，输出就要有多少段。
+输出要求：请按格式输出翻译结果，输出的第一行首先写从哪个语种翻译到哪个语种，格式为 "{source} -> {destination}"，语种用中文表达；紧接着输出每段的翻译，同样用 "----begin N----" 和 "----end N----" 包裹，N 与输入段落的编号保持一致。
+{{- end }}
 
+翻译要求：{{ if .Source }}原文是{{ .Source }}，{{ end }}请把内容翻译成{{index .Dest 0}}。如果它已经是{{index .Dest 0}}，则把它翻译成{{index .Dest 1}}。采用意译的翻译手法，含义准确，使用常见的单词和简练的句式，符合母语人士的表达习惯。必要时可以采用多阶段翻译，例如先直译一遍，然后在直译的基础上适当调整文法表达，或根据内容含义重新组织输出，最后再做一次精炼。每个段落独立翻译，每个段落都要有对应的翻译输出，即输入有多少段，输出就要有多少段。
+{{ if .Glossary }}
+术语要求：以下术语请严格按照术语表翻译，"保持原文" 表示该术语不要翻译，原样输出。
+{{- range .Glossary }}
+	{{ .Term }} => {{ if .Translation }}{{ .Translation }}{{ else }}保持原文{{ end }}
+{{- end }}
+{{ end }}
 另外请注意，有些段落可能整段都是一些无意义的 unicode 字符，这些内容可以直接输出，跳过翻译。
+{{- if .Placeholders }}
+段落中形如 ⟦0⟧ 的标记是占位符，代表不需要翻译的代码或格式，请在译文的对应位置原样保留每一个占位符，不要修改、删除或增加占位符。
+{{- end }}
 
 这里给出一个输入输出的示例：
+{{ if .JSON }}
+	输入：
+	{"id":0,"text":"hello"}
+	{"id":1,"text":"world"}
+	{"id":2,"text":"►"}
 
+	输出：
+	{"from":"英语","to":"中文","paragraphs":[{"id":0,"text":"你好"},{"id":1,"text":"世界"},{"id":2,"text":"►"}]}
+{{ else }}
 	输入：
-	----begin----
+	----begin 0----
 	hello
-	----end----
-	----begin----
+	----end 0----
+	----begin 1----
 	world
-	----end----
-	----begin----
+	----end 1----
+	----begin 2----
 	►
-	----end----
+	----end 2----
 
 	输出：
 	英语 -> 中文
-	----begin----
+	----begin 0----
 	你好
-	----end----
-	----begin----
+	----end 0----
+	----begin 1----
 	世界
-	----end----
-	----begin----
+	----end 1----
+	----begin 2----
 	►
-	----end----
-
+	----end 2----
+{{ end }}
 再强调一遍，输出的段落数目要和输入一样，顺序也要跟输入一致。
 
 以下是待翻译内容，请输出翻译后的内容，共有{{ len .Content }}个段落：
 {{- range $p := .Content  }}
 {{ $p }}
+{{- end }}
+	`))
+
+	allDestTemplate = template.Must(template.New("all_dest").Parse(`
+这个请求的发起时间为 {{.ReqTime}}。
+
+你是一名翻译员，精通各国语言，尤其是英语和中文；同时你也精通各种计算机技术，习惯在 github 或 stackoverflow 等网站发表专业评论。
+请帮我完成一些翻译，我现在会描述输入和输出的规则，真正需要翻译的内容我会在末尾给出。
+
+输入要求：待翻译的内容按目标语种分成若干组，每组以 "====翻译成 X====" 开头，X 是这一组的目标语种；组内每个段落以 "----begin N----" 开始，以 "----end N----" 结尾，N 是段落的编号，在所有组中都不重复；段落之间的内容是相互独立的，不要混在一起翻译。
+
+输出要求：请按格式输出翻译结果，输出的第一行首先写从哪个语种翻译到哪些语种，格式为 "{source} -> {destinations}"，语种用中文表达，多个目标语种用逗号分隔；紧接着输出每段的翻译，同样用 "----begin N----" 和 "----end N----" 包裹，N 与输入段落的编号保持一致，每个段落都翻译成它所在组的目标语种。
+
+翻译要求：{{ if .Source }}原文是{{ .Source }}，{{ end }}请把每组内容翻译成该组的目标语种，采用意译的翻译手法，含义准确，使用常见的单词和简练的句式，符合母语人士的表达习惯。必要时可以采用多阶段翻译，例如先直译一遍，然后在直译的基础上适当调整文法表达，或根据内容含义重新组织输出，最后再做一次精炼。每个段落独立翻译，每个段落都要有对应的翻译输出，即输入有多少段，输出就要有多少段。
+{{ range .Groups }}{{ if .Glossary }}
+术语要求：翻译成{{ .Dest }}时，以下术语请严格按照术语表翻译，"保持原文" 表示该术语不要翻译，原样输出。
+{{- range .Glossary }}
+	{{ .Term }} => {{ if .Translation }}{{ .Translation }}{{ else }}保持原文{{ end }}
+{{- end }}
+{{ end }}{{ end }}
+另外请注意，有些段落可能整段都是一些无意义的 unicode 字符，这些内容可以直接输出，跳过翻译。
+{{- if .Placeholders }}
+段落中形如 ⟦0⟧ 的标记是占位符，代表不需要翻译的代码或格式，请在译文的对应位置原样保留每一个占位符，不要修改、删除或增加占位符。
+{{- end }}
+
+这里给出一个输入输出的示例：
+
+	输入：
+	====翻译成中文====
+	----begin 0----
+	hello
+	----end 0----
+	====翻译成日语====
+	----begin 1----
+	hello
+	----end 1----
+
+	输出：
+	英语 -> 中文, 日语
+	----begin 0----
+	你好
+	----end 0----
+	----begin 1----
+	こんにちは
+	----end 1----
+
+再强调一遍，输出的段落数目要和输入一样，顺序也要跟输入一致。
+
+以下是待翻译内容，请输出翻译后的内容，共有{{ len .Content }}个段落：
+{{- range .Groups }}
+====翻译成{{ .Dest }}====
+{{- range $p := .Content }}
+{{ $p }}
+{{- end }}
 {{- end }}
 	`))
 )
 
+// errTruncated means the output is cut off by the output limit of the model.
+var errTruncated = errors.New("the output is truncated by the output token limit")
+
 type TranslateResult struct {
 	Err  error
 	Resp *TranslateResp
 }
 
+// sessionOptions are the optional settings of a session.
+type sessionOptions struct {
+	// endpoint is the entry of the request, e.g. "hcfy" or "cjsfy", for the
+	// endpoint specific config
+	endpoint string
+	// paraCh receives the paragraphs as soon as they are parsed from the
+	// streamed output, if not nil
+	paraCh chan *Paragraph
+	// source is the language of the input given by the client, it's
+	// detected if empty or "auto"
+	source string
+	// model overrides the model of the backend if not empty
+	model string
+	// generation overrides the generation parameters of the endpoint, if not
+	// nil
+	generation *config.GenerationConfig
+	// targets are the destinations of every input paragraph, if not nil, to
+	// translate into several destinations in one request
+	targets []string
+}
+
 type session struct {
+	ctx    context.Context
 	dest   []string
 	input  []string
 	respCh chan *TranslateResult
+	opts   sessionOptions
+	// source is the name of the input language, empty if unknown
+	source string
+	// codes is true if the client names the languages by codes, e.g. "en",
+	// the response follows it
+	codes bool
+	// raw is the input before the markup is protected, input is the
+	// protected one
+	raw       []string
+	protected []*protectedText
+	// origin maps the input to the raw paragraphs, pieces is the count of the
+	// input pieces of every raw paragraph, a long paragraph is split into
+	// several pieces
+	origin []int
+	pieces []int
+	// targets are the hcfy names of the destinations of every input piece,
+	// see sessionOptions.targets
+	targets []string
+	// emitted are the texts of the raw paragraphs that have been sent to
+	// paraCh
+	emitted map[int]string
 }
 
-func newSession(dest []string, input []string, respCh chan *TranslateResult) *session {
+func newSession(ctx context.Context, dest []string, input []string, respCh chan *TranslateResult,
+	opts sessionOptions) *session {
 	return &session{
+		ctx:    ctx,
 		dest:   dest,
 		input:  input,
 		respCh: respCh,
+		opts:   opts,
 	}
 }
 
@@ -142,92 +289,668 @@ func (s *session) fire(id string) {
 			s.respCh <- &TranslateResult{Err: err}
 		}
 	}()
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(s.ctx)
 	defer cancel()
-	var tmpl *template.Template
+	backend, err := getBackend()
+	if err != nil {
+		log.Errorf("%s", err)
+		s.respCh <- &TranslateResult{Err: err}
+		return
+	}
+
+	s.protect()
+	s.splitLong()
+	s.resolveLanguage()
+	translated, err := s.translate(ctx, backend)
+	if err != nil {
+		s.respCh <- &TranslateResult{Err: err}
+		return
+	}
+	translated.Result = s.joinPieces(translated.Result)
+	for idx := range translated.Result {
+		translated.Result[idx] = s.restore(idx, translated.Result[idx])
+	}
+	// a streamed paragraph may be requested again, e.g. after the output is
+	// truncated, keep the result the same as the stream
+	for idx, text := range s.emitted {
+		translated.Result[idx] = text
+	}
+	translated.Text = strings.Join(s.raw, "\n")
+	s.settleLanguages(translated)
+	s.respCh <- &TranslateResult{Resp: translated}
+}
+
+// settleLanguages fills the languages of the response with the known ones,
+// in the vocabulary of the client.
+func (s *session) settleLanguages(resp *TranslateResp) {
+	if s.source != "" {
+		resp.From = s.source
+	}
 	if len(s.dest) == 1 {
-		tmpl = singleDestTemplate
+		resp.To = s.dest[0]
+	}
+	// the model may phrase the languages in its own way
+	resp.From = s.languageOf(resp.From)
+	resp.To = s.languageOf(resp.To)
+}
+
+// protect replaces the markup in the input with the placeholders, which are
+// restored after the translation.
+func (s *session) protect() {
+	s.raw = s.input
+	s.input = make([]string, len(s.raw))
+	s.protected = make([]*protectedText, len(s.raw))
+	for idx, p := range s.raw {
+		s.protected[idx] = protect(p)
+		s.input[idx] = s.protected[idx].text
+	}
+}
+
+// splitLong splits the paragraphs whose output may exceed the output limit of
+// the model at the sentence boundaries, they are joined by joinPieces after
+// the translation.
+func (s *session) splitLong() {
+	budget := outputBudget(s.opts.endpoint)
+	var input []string
+	s.origin = nil
+	s.pieces = make([]int, len(s.input))
+	for idx, p := range s.input {
+		pieces := []string{p}
+		if outputTokens(p) > budget {
+			pieces = splitSentences(p, budget)
+			log.Debugf("paragraph %d is split into %d pieces", idx, len(pieces))
+		}
+		for _, piece := range pieces {
+			input = append(input, piece)
+			s.origin = append(s.origin, idx)
+		}
+		s.pieces[idx] = len(pieces)
+	}
+	s.input = input
+}
+
+// joinPieces joins the translated pieces back to the raw paragraphs.
+func (s *session) joinPieces(result []string) []string {
+	if len(s.origin) == 0 {
+		return result
+	}
+	pieces := make([][]string, len(s.pieces))
+	for idx, r := range result {
+		o := s.origin[idx]
+		pieces[o] = append(pieces[o], r)
+	}
+	joined := make([]string, len(pieces))
+	for idx, p := range pieces {
+		joined[idx] = joinPieces(p)
+	}
+	return joined
+}
+
+func (s *session) restore(idx int, translated string) string {
+	if idx >= len(s.protected) {
+		return translated
+	}
+	return s.protected[idx].restore(translated)
+}
+
+// resolveLanguage decides the source language, from the client or by
+// detection. If it's known, the destination is settled here rather than
+// leaving the choice to the model. The known languages are referred by their
+// hcfy names in the prompt.
+func (s *session) resolveLanguage() {
+	s.codes = len(s.dest) > 0 && lang.IsCode(s.dest[0])
+	dest := make([]string, len(s.dest))
+	for i, d := range s.dest {
+		dest[i] = lang.Name(d)
+	}
+	s.dest = dest
+
+	var code string
+	if source := strings.TrimSpace(s.opts.source); source != "" && !strings.EqualFold(source, "auto") {
+		s.source = lang.Name(source)
+		code = lang.Code(source)
+	} else if code = lang.Detect(strings.Join(s.input, "\n")); code != "" {
+		s.source = lang.Name(code)
+	}
+	if s.opts.targets != nil {
+		s.targets = make([]string, len(s.input))
+		for idx := range s.input {
+			s.targets[idx] = lang.Name(s.opts.targets[s.origin[idx]])
+		}
+		return
+	}
+	if code == "" || len(s.dest) < 2 {
+		return
+	}
+	to := s.dest[0]
+	if lang.Same(code, lang.Code(to)) {
+		to = s.dest[1]
+	}
+	log.Debugf("source language: %s, destination: %s", s.source, to)
+	s.dest = []string{to}
+}
+
+// languageOf returns the canonical form of the language in the vocabulary of
+// the client, i.e. the code or the hcfy name. The unknown ones are returned
+// as is.
+func (s *session) languageOf(name string) string {
+	return languageIn(name, s.codes)
+}
+
+// languageIn returns the code of the language if codes is true, or the hcfy
+// name otherwise. The unknown ones are returned as is.
+func languageIn(name string, codes bool) string {
+	l := lang.Lookup(name)
+	if l == nil {
+		return name
+	}
+	if codes {
+		return l.Code
+	}
+	return l.Name
+}
+
+// translate translates all the input paragraphs. The paragraphs missing from
+// the output, looking broken, or violating the glossary are requested again,
+// instead of retrying the whole session.
+func (s *session) translate(ctx context.Context, backend Backend) (*TranslateResp, error) {
+	cfg := config.ReadConfig()
+	maxRounds := cfg.SalvageRetries
+	if maxRounds <= 0 {
+		maxRounds = defaultSalvageRetries
+	}
+	resp := &TranslateResp{
+		Result: make([]string, len(s.input)),
+	}
+	pending := make([]int, len(s.input))
+	for idx := range pending {
+		pending[idx] = idx
+	}
+	glossaryRounds := 0
+	for round := 0; ; round++ {
+		if err := ctx.Err(); err != nil {
+			// the caller has gone away
+			return nil, err
+		}
+		translated, err := s.runChunks(ctx, backend, pending)
+		if err != nil {
+			return nil, err
+		}
+		if resp.From == "" {
+			resp.From, resp.To = translated.From, translated.To
+		}
+		var missing []int
+		for i, idx := range pending {
+			if isSuspicious(s.input[idx], translated.Result[i]) {
+				missing = append(missing, idx)
+			} else {
+				resp.Result[idx] = translated.Result[i]
+			}
+		}
+		if len(missing) == 0 {
+			violations := s.checkGlossary(resp)
+			for _, v := range violations {
+				log.Warnf("glossary violation, term %q should be rendered as %q, input: %q, translation: %q",
+					v.entry.Term, v.entry.Rendering(), s.input[v.index], resp.Result[v.index])
+			}
+			if len(violations) == 0 || glossaryRounds >= cfg.GlossaryRetries {
+				return resp, nil
+			}
+			glossaryRounds++
+			seen := map[int]bool{}
+			for _, v := range violations {
+				if !seen[v.index] {
+					seen[v.index] = true
+					missing = append(missing, v.index)
+				}
+			}
+			slices.Sort(missing)
+		} else if round >= maxRounds {
+			log.Errorf("%d paragraphs are still missing after %d rounds", len(missing), round+1)
+			return nil, fmt.Errorf("number of translation result (%d) doesn't match the request (%d)",
+				len(s.input)-len(missing), len(s.input))
+		}
+		log.Warnf("request %d of %d paragraphs again", len(missing), len(s.input))
+		pending = missing
+	}
+}
+
+// emit sends the streamed translation of the input idx to paraCh, with the
+// index of the raw paragraph. The pieces of a long paragraph are not sent, it
+// will be in the final result, so are the ones with the glossary terms.
+// Every paragraph is sent at most once, even if it's requested again, so
+// paraCh never holds more than the input. The sent text is also the one in
+// the final result.
+func (s *session) emit(idx int, text string) {
+	origin := idx
+	if idx < len(s.origin) {
+		origin = s.origin[idx]
+		if s.pieces[origin] > 1 {
+			return
+		}
+	}
+	if _, ok := s.emitted[origin]; ok || s.hasGlossaryTerms(idx) {
+		return
+	}
+	if s.emitted == nil {
+		s.emitted = map[int]string{}
+	}
+	text = s.restore(origin, text)
+	s.emitted[origin] = text
+	select {
+	case s.opts.paraCh <- &Paragraph{Index: origin, Text: text}:
+	case <-s.ctx.Done():
+	}
+}
+
+// runChunks is like run, but splits the paragraphs into chunks, so that the
+// output of every chunk fits in the output limit of the model. A chunk whose
+// output is truncated anyway is requested again in halves, down to a single
+// paragraph, which is then requested in smaller pieces.
+func (s *session) runChunks(ctx context.Context, backend Backend, index []int) (*TranslateResp, error) {
+	chunks := chunkByTokens(s.input, index, outputBudget(s.opts.endpoint))
+	if len(chunks) > 1 {
+		log.Debugf("%d paragraphs are split into %d chunks", len(index), len(chunks))
+	}
+	resp := &TranslateResp{}
+	for len(chunks) > 0 {
+		chunk := chunks[0]
+		chunks = chunks[1:]
+		translated, err := s.run(ctx, backend, chunk)
+		if errors.Is(err, errTruncated) && len(chunk) > 1 {
+			log.Warnf("the output of %d paragraphs is truncated, request them in halves", len(chunk))
+			half := len(chunk) / 2
+			chunks = append([][]int{chunk[:half], chunk[half:]}, chunks...)
+			continue
+		}
+		if errors.Is(err, errTruncated) {
+			idx := chunk[0]
+			translated, err = s.runPieces(ctx, backend, idx, outputTokens(s.input[idx])/2, 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.From == "" {
+			resp.From, resp.To = translated.From, translated.To
+		}
+		resp.Result = append(resp.Result, translated.Result...)
+	}
+	return resp, nil
+}
+
+// runPieces translates the paragraph at idx in the pieces split at the
+// sentence boundaries, for a paragraph whose output is truncated as a whole.
+// The budget is halved until the output fits, it gives up if the paragraph
+// can't be split into more than prev pieces. The paragraph is left empty if
+// any piece is missing, to be requested again.
+func (s *session) runPieces(ctx context.Context, backend Backend, idx int, budget int, prev int) (*TranslateResp, error) {
+	pieces := splitSentences(s.input[idx], budget)
+	if len(pieces) <= prev {
+		log.Warnf("the output of paragraph %d is truncated, and it can't be split any more", idx)
+		return nil, &BackendError{Class: ErrFatal, Err: errTruncated}
+	}
+	log.Warnf("the output of paragraph %d is truncated, request it in %d pieces", idx, len(pieces))
+	all := make([]int, len(pieces))
+	for i := range all {
+		all[i] = i
+	}
+	resp := &TranslateResp{}
+	var result []string
+	for _, chunk := range chunkByTokens(pieces, all, budget) {
+		index := make([]int, len(chunk))
+		input := make([]string, len(chunk))
+		for i, p := range chunk {
+			index[i] = idx
+			input[i] = pieces[p]
+		}
+		translated, err := s.runInput(ctx, backend, index, input, false)
+		if errors.Is(err, errTruncated) {
+			return s.runPieces(ctx, backend, idx, budget/2, len(pieces))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.From == "" {
+			resp.From, resp.To = translated.From, translated.To
+		}
+		for i, p := range input {
+			if isSuspicious(p, translated.Result[i]) {
+				resp.Result = []string{""}
+				return resp, nil
+			}
+		}
+		result = append(result, translated.Result...)
+	}
+	resp.Result = []string{joinPieces(result)}
+	return resp, nil
+}
+
+// run translates the input paragraphs at the index, the result is aligned
+// with the index and the missing paragraphs are left empty.
+func (s *session) run(ctx context.Context, backend Backend, index []int) (*TranslateResp, error) {
+	input := make([]string, len(index))
+	for i, idx := range index {
+		input[i] = s.input[idx]
+	}
+	return s.runInput(ctx, backend, index, input, s.opts.paraCh != nil)
+}
+
+// runInput is like run with the given input, index tells the input
+// paragraphs that the input comes from. The translation is streamed if stream
+// is true and the backend supports it.
+func (s *session) runInput(ctx context.Context, backend Backend, index []int, input []string, stream bool) (*TranslateResp, error) {
+	_, canStream := backend.(StreamBackend)
+	stream = stream && canStream
+	// the stream parser relies on the markers, so streaming sessions always
+	// use the marker format
+	jsonMode := !stream && s.targets == nil && useJSONOutput(backend, s.opts.model)
+
+	var tmpl *template.Template
+	if s.targets != nil {
+		tmpl = getTemplate(promptAllDest)
+	} else if len(s.dest) == 1 {
+		tmpl = getTemplate(promptSingleDest)
 	} else if len(s.dest) >= 2 {
-		tmpl = multiDestTemplate
+		tmpl = getTemplate(promptMultiDest)
 	}
 	out := bytes.NewBuffer(nil)
 	var content []string
-	for _, p := range s.input {
-		content = append(content, beginMarker+"\n"+p+"\n"+endMarker)
-	}
-	tmpl.Execute(out, struct {
-		ReqTime string
-		Dest    []string
-		Content []string
-	}{
+	if jsonMode {
+		content = jsonContent(input)
+	} else {
+		for id, p := range input {
+			content = append(content, beginMarkerOf(id)+"\n"+p+"\n"+endMarkerOf(id))
+		}
+	}
+	var glossary []*GlossaryEntry
+	var groups []*promptGroup
+	if s.targets != nil {
+		groups = s.groups(index, input, content)
+	} else {
+		glossary = matchGlossary(s.dest, input)
+	}
+	err := tmpl.Execute(out, &promptData{
 		ReqTime: time.Now().String(),
 		Dest:    s.dest,
-		Content: content,
+		Source:  s.source,
+		Placeholders: slices.ContainsFunc(input, func(p string) bool {
+			return placeholderPattern.MatchString(p)
+		}),
+		Content:  content,
+		JSON:     jsonMode,
+		Vars:     config.ReadConfig().PromptVars,
+		Glossary: glossary,
+		Groups:   groups,
 	})
+	if err != nil {
+		log.Errorf("failed to render prompt: %s", err)
+		return nil, err
+	}
 
 	ask := out.String()
+	if err := checkPrompt(ctx, backend, s.opts.model, ask); err != nil {
+		return nil, err
+	}
 	// log.Debugf("ask: %s", ask)
 	log.Debugf("content: %s", strings.Join(content, "\n"))
-	apiKey := config.ReadConfig().APIKey
-	if apiKey == "" {
-		apiKey = os.Getenv("GEMINI_API_KEY")
-		if apiKey == "" {
-			panic("GEMINI_API_KEY is not defined")
-		}
+	backendReq := &BackendRequest{
+		Prompt:     ask,
+		Model:      s.opts.model,
+		Generation: config.GetGenerationConfig(s.opts.endpoint).Merge(s.opts.generation),
 	}
-	modelName := config.ReadConfig().ModelName
-	if modelName == "" {
-		modelName = os.Getenv("MODEL_NAME")
+	if jsonMode {
+		backendReq.ResponseSchema = translateSchema
 	}
-	cfg := gemini.GenerateTextConfig{
-		APIKey:    apiKey,
-		ModelName: modelName,
-		Prompt:    ask,
+	ctx, cancel := attemptContext(ctx)
+	defer cancel()
+	var resp *BackendResponse
+	if stream {
+		parser := newStreamParser(len(input), func(p *Paragraph) {
+			if !isSuspicious(input[p.Index], p.Text) {
+				s.emit(index[p.Index], p.Text)
+			}
+		})
+		resp, err = backend.(StreamBackend).GenerateStream(ctx, backendReq, parser.feed)
+	} else {
+		resp, err = backend.Generate(ctx, backendReq)
 	}
-	resp, err := gemini.GenerateText(ctx, cfg)
 	if err != nil {
-		log.Errorf("gemini err: %T \"%s\"", err, err.Error())
-		s.respCh <- &TranslateResult{Err: err}
-		return
+		log.Errorf("backend err: %T \"%s\"", err, err.Error())
+		return nil, err
 	}
-	log.Debugf("answer: %s", resp)
+	log.Debugf("usage: prompt %d, output %d, total %d tokens",
+		resp.Usage.PromptTokens, resp.Usage.OutputTokens, resp.Usage.TotalTokens)
+	observeTokens(ask, resp.Usage.PromptTokens)
+	switch resp.FinishReason {
+	case FinishMaxTokens:
+		log.Warnf("the output is truncated, %d output tokens", resp.Usage.OutputTokens)
+		return nil, &BackendError{Class: ErrFatal, Err: errTruncated}
+	case FinishSafety:
+		for _, r := range resp.SafetyRatings {
+			log.Warnf("safety rating: %s %s, blocked: %v", r.Category, r.Probability, r.Blocked)
+		}
+	}
+	log.Debugf("answer: %s", resp.Text)
 
-	translated := parseResp(resp)
-	if translated == nil {
+	if jsonMode {
+		translated, err := parseJSONResp(resp.Text, len(input))
+		if err == nil {
+			return translated, nil
+		}
+		// the model may ignore the schema, try the marker format
+		log.Warnf("can't parse structured result, err: %s", err)
+	}
+	from, to, paragraphs, ok := parseMarked(resp.Text)
+	if !ok {
 		log.Errorf("can't parse translate result from gemini, input: %q, response: %q",
-			s.input, resp)
-		err := fmt.Errorf("can't parse translate result from gemini")
-		s.respCh <- &TranslateResult{Err: err}
-		return
+			input, resp.Text)
+		return nil, fmt.Errorf("can't parse translate result from gemini")
 	}
+	return &TranslateResp{
+		From:   from,
+		To:     to,
+		Result: assemble(paragraphs, len(input)),
+	}, nil
+}
 
-	translated.Text = strings.Join(s.input, "\n")
-	s.respCh <- &TranslateResult{Resp: translated}
+// hasGlossaryTerms reports whether the input idx contains the terms of the
+// glossary that will be checked. Its translation may be corrected by a retry,
+// so it's not streamed but held until the final result.
+func (s *session) hasGlossaryTerms(idx int) bool {
+	if config.ReadConfig().GlossaryRetries <= 0 {
+		return false
+	}
+	dest := s.dest
+	if s.targets != nil {
+		dest = []string{s.targets[idx]}
+	} else if len(s.dest) != 1 {
+		return false
+	}
+	return len(matchGlossary(dest, []string{s.input[idx]})) > 0
 }
 
-func parseResp(text string) *TranslateResp {
-	var result *TranslateResp
-	for _, matches := range resultPattern.FindAllStringSubmatch(text, -1) {
-		content := matches[3]
-		var paragraphs []string
-		for {
-			pos := strings.Index(content, beginMarker)
-			if pos == -1 {
-				break
+// groups groups the content of the input paragraphs at the index by their
+// destinations, in the order of s.dest.
+func (s *session) groups(index []int, input []string, content []string) []*promptGroup {
+	var groups []*promptGroup
+	for _, d := range s.dest {
+		g := &promptGroup{Dest: d}
+		var groupInput []string
+		for i, idx := range index {
+			if s.targets[idx] == d {
+				g.Content = append(g.Content, content[i])
+				groupInput = append(groupInput, input[i])
+			}
+		}
+		if len(g.Content) > 0 {
+			g.Glossary = matchGlossary([]string{d}, groupInput)
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// checkGlossary checks the translation against the glossary, it's only
+// possible when the destination is certain.
+func (s *session) checkGlossary(translated *TranslateResp) []*glossaryViolation {
+	if s.targets != nil {
+		var violations []*glossaryViolation
+		for _, d := range s.dest {
+			g := getGlossary(d)
+			if g == nil {
+				continue
 			}
-			content = content[pos+len(beginMarker):]
-			pos = strings.Index(content, endMarker)
-			if pos == -1 {
-				break
+			// only the paragraphs into d are checked
+			input := make([]string, len(s.input))
+			for idx, p := range s.input {
+				if s.targets[idx] == d {
+					input[idx] = p
+				}
 			}
-			paragraphs = append(paragraphs, strings.TrimSpace(content[:pos]))
-			content = content[pos+len(endMarker):]
+			violations = append(violations, g.check(input, translated.Result)...)
 		}
-		result = &TranslateResp{
-			From:   strings.TrimSpace(matches[1]),
-			To:     strings.TrimSpace(matches[2]),
-			Result: paragraphs,
+		return violations
+	}
+	if len(s.dest) != 1 {
+		return nil
+	}
+	g := getGlossary(s.dest[0])
+	if g == nil {
+		return nil
+	}
+	return g.check(s.input, translated.Result)
+}
+
+// markedParagraph is a paragraph wrapped by the markers, id is -1 if the
+// markers are not numbered.
+type markedParagraph struct {
+	id   int
+	text string
+}
+
+func beginMarkerOf(id int) string {
+	return fmt.Sprintf("----begin %d----", id)
+}
+
+func endMarkerOf(id int) string {
+	return fmt.Sprintf("----end %d----", id)
+}
+
+// nextParagraph finds the first complete paragraph in text, and returns the
+// rest of the text after it.
+func nextParagraph(text string) (*markedParagraph, string, bool) {
+	loc := beginPattern.FindStringSubmatchIndex(text)
+	if loc == nil {
+		return nil, text, false
+	}
+	content := text[loc[1]:]
+	endLoc := endPattern.FindStringIndex(content)
+	if endLoc == nil {
+		return nil, text, false
+	}
+	p := &markedParagraph{
+		id:   -1,
+		text: strings.TrimSpace(content[:endLoc[0]]),
+	}
+	if loc[2] != -1 {
+		p.id, _ = strconv.Atoi(text[loc[2]:loc[3]])
+	}
+	return p, content[endLoc[1]:], true
+}
+
+// parseMarked parses the marker format. The "{source} -> {destination}"
+// header is optional, and if the model skipped the markers, every non-empty
+// line after the header is taken as a paragraph.
+func parseMarked(text string) (from string, to string, paragraphs []*markedParagraph, ok bool) {
+	text = stripCodeFence(text)
+	body := text
+	head := text
+	if loc := beginPattern.FindStringIndex(text); loc != nil {
+		head = text[:loc[0]]
+	}
+	offset := 0
+	for _, line := range strings.SplitAfter(head, "\n") {
+		if matches := headerPattern.FindStringSubmatch(line); matches != nil {
+			from = matches[1]
+			to = matches[2]
+			body = text[offset+len(line):]
+			break
+		}
+		offset += len(line)
+	}
+
+	content := body
+	for {
+		p, rest, found := nextParagraph(content)
+		if !found {
+			break
+		}
+		paragraphs = append(paragraphs, p)
+		content = rest
+	}
+	if paragraphs == nil {
+		if from == "" {
+			return "", "", nil, false
+		}
+		for _, line := range strings.Split(body, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				paragraphs = append(paragraphs, &markedParagraph{id: -1, text: line})
+			}
+		}
+	}
+	return from, to, paragraphs, true
+}
+
+// parseResp parses the marker format, the paragraphs are returned in the
+// order they appear.
+func parseResp(text string) *TranslateResp {
+	from, to, paragraphs, ok := parseMarked(text)
+	if !ok {
+		return nil
+	}
+	result := &TranslateResp{
+		From: from,
+		To:   to,
+	}
+	for _, p := range paragraphs {
+		result.Result = append(result.Result, p.text)
+	}
+	return result
+}
+
+// assemble matches the parsed paragraphs back to the n input paragraphs. The
+// numbered ones are placed by their ids, the unnumbered ones are only usable
+// if the count matches. The missing paragraphs are left empty.
+func assemble(paragraphs []*markedParagraph, n int) []string {
+	result := make([]string, n)
+	seen := make([]bool, n)
+	numbered := true
+	for _, p := range paragraphs {
+		if p.id == -1 {
+			numbered = false
+			continue
+		}
+		if p.id >= 0 && p.id < n && !seen[p.id] {
+			seen[p.id] = true
+			result[p.id] = p.text
+		}
+	}
+	if !numbered && len(paragraphs) == n {
+		for idx, p := range paragraphs {
+			if !seen[idx] {
+				result[idx] = p.text
+			}
 		}
 	}
 	return result
 }
+
+// isSuspicious reports whether the translation of the input paragraph looks
+// broken and should be requested again.
+func isSuspicious(input string, translated string) bool {
+	if translated == "" {
+		return strings.TrimSpace(input) != ""
+	}
+	return strings.Contains(translated, "----begin") || strings.Contains(translated, "----end") ||
+		lostPlaceholder(input, translated)
+}
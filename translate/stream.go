@@ -0,0 +1,79 @@
+package translate
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Paragraph is a translated paragraph emitted before the whole response is
+// finished, Index is the position of the paragraph in the input.
+type Paragraph struct {
+	Index int
+	Text  string
+}
+
+// streamParser extracts the paragraphs wrapped by the begin/end markers from
+// the streamed output incrementally.
+type streamParser struct {
+	buf         string
+	next        int
+	max         int
+	emitted     []bool
+	onParagraph func(p *Paragraph)
+}
+
+func newStreamParser(max int, onParagraph func(p *Paragraph)) *streamParser {
+	return &streamParser{
+		max:         max,
+		emitted:     make([]bool, max),
+		onParagraph: onParagraph,
+	}
+}
+
+func (p *streamParser) feed(chunk string) {
+	p.buf += chunk
+	for {
+		para, rest, ok := nextParagraph(p.buf)
+		if !ok {
+			return
+		}
+		idx := para.id
+		if idx == -1 {
+			idx = p.next
+		}
+		if idx >= 0 && idx < p.max && !p.emitted[idx] {
+			p.emitted[idx] = true
+			p.onParagraph(&Paragraph{
+				Index: idx,
+				Text:  para.text,
+			})
+		}
+		p.next++
+		p.buf = rest
+	}
+}
+
+// TranslateStream is like Translate, but also sends every translated
+// paragraph to paraCh as soon as it's parsed from the backend output. paraCh
+// should have enough buffer for all the lines of req.Text, and it's not
+// closed after the session is done.
+func TranslateStream(ctx context.Context, req *TranslateReq, ch chan *TranslateResult, paraCh chan *Paragraph) {
+	req.Text = strings.TrimSpace(req.Text)
+	if len(req.Destination) == 0 || req.Text == "" {
+		log.Errorf("bad translate req: %+v", req)
+		return
+	}
+	opts := sessionOptions{
+		endpoint: EndpointHcfy,
+		source:   req.Source,
+	}
+	if req.allDestinations() {
+		// the paragraphs can't be streamed in multiple languages
+		translateAll(ctx, req.Destination, strings.Split(req.Text, "\n"), ch, opts)
+		return
+	}
+	opts.paraCh = paraCh
+	startSession(ctx, req.Destination, strings.Split(req.Text, "\n"), ch, opts)
+}
@@ -0,0 +1,106 @@
+package translate
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+func TestStreamParser(t *testing.T) {
+	var got []*Paragraph
+	p := newStreamParser(2, func(p *Paragraph) {
+		got = append(got, p)
+	})
+	chunks := []string{
+		"英语 -> 中文\n----beg",
+		"in----\n你好\n----end----\n----begin----\n世",
+		"界\n----end",
+		"----\n----begin----\n多余\n----end----\n",
+	}
+	for _, c := range chunks {
+		p.feed(c)
+	}
+	expect := []*Paragraph{
+		{Index: 0, Text: "你好"},
+		{Index: 1, Text: "世界"},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("bad result, expected: %+v, actual: %+v", expect, got)
+	}
+}
+
+func TestEmitOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	paraCh := make(chan *Paragraph, 2)
+	s := newSession(ctx, []string{"中文"}, []string{"a", "b"}, nil, sessionOptions{paraCh: paraCh})
+	s.protect()
+	s.splitLong()
+	s.emit(0, "A")
+	s.emit(0, "A again")
+	s.emit(1, "B")
+	if len(paraCh) != 2 {
+		t.Fatalf("every paragraph should be sent once, sent: %d", len(paraCh))
+	}
+	if p := <-paraCh; p.Index != 0 || p.Text != "A" {
+		t.Errorf("bad paragraph: %+v", p)
+	}
+
+	// the consumer has gone away
+	paraCh <- &Paragraph{}
+	s.emitted = nil
+	cancel()
+	s.emit(0, "A")
+}
+
+// fakeStreamBackend streams the output of fakeBackend, the paragraphs
+// requested again are phrased differently.
+type fakeStreamBackend struct {
+	*fakeBackend
+	calls int
+}
+
+func (b *fakeStreamBackend) GenerateStream(ctx context.Context, req *BackendRequest, onChunk func(text string)) (*BackendResponse, error) {
+	resp, err := b.Generate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if b.calls++; b.calls > 1 {
+		resp.Text = strings.ReplaceAll(resp.Text, "\nA\n", "\nA AGAIN\n")
+	}
+	onChunk(resp.Text)
+	return resp, nil
+}
+
+func TestStreamTruncated(t *testing.T) {
+	fake := &fakeStreamBackend{fakeBackend: &fakeBackend{}}
+	fake.truncate = func(input []string) bool {
+		return len(input) > 1
+	}
+	RegisterBackend("fake_stream", func(cfg *config.Config) (Backend, error) {
+		return fake, nil
+	})
+	config.ReadConfig().Backend = "fake_stream"
+	t.Cleanup(func() {
+		config.ReadConfig().Backend = ""
+	})
+
+	ch := make(chan *TranslateResult, 1)
+	paraCh := make(chan *Paragraph, 2)
+	// the first paragraph is streamed before the output is cut off
+	long := strings.Repeat("b", 100)
+	Translate2Stream(context.Background(), []string{"a", long}, "中文", nil, ch, paraCh)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if p := <-paraCh; p.Index != 0 || p.Text != "A" {
+		t.Fatalf("bad streamed paragraph: %+v", p)
+	}
+	if expect := []string{"A", strings.ToUpper(long)}; !reflect.DeepEqual(result.Resp.Result, expect) {
+		t.Errorf("the result should be the same as the stream, expected: %q, actual: %q",
+			expect, result.Resp.Result)
+	}
+}
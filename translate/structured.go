@@ -0,0 +1,99 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+const outputModeJSON = "json"
+
+// translateSchema is the schema of the structured output, the paragraphs are
+// tagged with the ids of the input paragraphs.
+var translateSchema = &Schema{
+	Type: "object",
+	Properties: map[string]*Schema{
+		"from": {Type: "string", Description: "源语种"},
+		"to":   {Type: "string", Description: "目标语种"},
+		"paragraphs": {
+			Type: "array",
+			Items: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"id":   {Type: "integer"},
+					"text": {Type: "string"},
+				},
+				Required: []string{"id", "text"},
+			},
+		},
+	},
+	Required: []string{"from", "to", "paragraphs"},
+}
+
+type jsonParagraph struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+type jsonResp struct {
+	From       string           `json:"from"`
+	To         string           `json:"to"`
+	Paragraphs []*jsonParagraph `json:"paragraphs"`
+}
+
+// useJSONOutput reports whether the session should ask for structured output
+// from the model, empty for the configured one.
+func useJSONOutput(backend Backend, model string) bool {
+	if !strings.EqualFold(config.ReadConfig().OutputMode, outputModeJSON) {
+		return false
+	}
+	sb, ok := backend.(SchemaBackend)
+	return ok && sb.SupportsSchema(model)
+}
+
+func jsonContent(input []string) []string {
+	var content []string
+	for idx, p := range input {
+		data, _ := json.Marshal(&jsonParagraph{ID: idx, Text: p})
+		content = append(content, string(data))
+	}
+	return content
+}
+
+// parseJSONResp decodes the structured output, and matches the paragraphs
+// back to the n input paragraphs by their ids. The missing paragraphs are
+// left empty.
+func parseJSONResp(text string, n int) (*TranslateResp, error) {
+	resp := &jsonResp{}
+	if err := json.Unmarshal([]byte(stripCodeFence(text)), resp); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+	var paragraphs []*markedParagraph
+	for _, p := range resp.Paragraphs {
+		if p != nil && p.ID >= 0 {
+			paragraphs = append(paragraphs, &markedParagraph{id: p.ID, text: strings.TrimSpace(p.Text)})
+		}
+	}
+	return &TranslateResp{
+		From:   strings.TrimSpace(resp.From),
+		To:     strings.TrimSpace(resp.To),
+		Result: assemble(paragraphs, n),
+	}, nil
+}
+
+// stripCodeFence removes the markdown code fence around the text, if any.
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") {
+		return text
+	}
+	if pos := strings.Index(text, "\n"); pos != -1 {
+		text = text[pos+1:]
+	} else {
+		return text
+	}
+	text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	return strings.TrimSpace(text)
+}
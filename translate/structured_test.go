@@ -0,0 +1,55 @@
+package translate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONResp(t *testing.T) {
+	text := "```json\n" +
+		`{"from":"英语","to":"中文","paragraphs":[{"id":1,"text":" 世界 "},{"id":0,"text":"你好"}]}` +
+		"\n```"
+	result, err := parseJSONResp(text, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expect := &TranslateResp{
+		From:   "英语",
+		To:     "中文",
+		Result: []string{"你好", "世界"},
+	}
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("bad result, expected: %+v, actual: %+v", expect, result)
+	}
+
+	// the missing paragraphs are left empty, and the first one wins for the
+	// duplicated ids
+	result, err = parseJSONResp(`{"paragraphs":[{"id":1,"text":"a"},{"id":1,"text":"b"},{"id":5,"text":"c"}]}`, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expect := []string{"", "a"}; !reflect.DeepEqual(result.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, result.Result)
+	}
+	if _, err := parseJSONResp(`not json`, 2); err == nil {
+		t.Errorf("expect error for invalid json")
+	}
+}
+
+func TestSupportsSchema(t *testing.T) {
+	b := &geminiBackend{modelName: "gemini-1.5-flash"}
+	cases := []struct {
+		model  string
+		expect bool
+	}{
+		{"", true},
+		{"gemini-1.5-pro", true},
+		{"gemini-1.0-pro", false},
+		{"models/gemini-pro", false},
+	}
+	for _, c := range cases {
+		if b.SupportsSchema(c.model) != c.expect {
+			t.Errorf("bad schema support of %q, expected: %v", c.model, c.expect)
+		}
+	}
+}
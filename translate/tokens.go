@@ -0,0 +1,160 @@
+package translate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+const (
+	defaultMaxInputTokens  = 30720
+	defaultMaxOutputTokens = 8192
+
+	// the translation may be longer than the input, e.g. from English to
+	// German
+	outputExpansion = 1.5
+	// the tokens of the markers around a paragraph
+	paragraphOverhead = 12
+)
+
+// tokenRatio calibrates the local estimation by the actual token counts, it's
+// the bits of a float64, 1.0 initially.
+var tokenRatio atomic.Uint64
+
+func init() {
+	tokenRatio.Store(math.Float64bits(1))
+}
+
+// rawTokens is a rough estimation of the tokens of text: a CJK character is
+// about a token, a word in the other scripts is a token for every 4 letters,
+// and a punctuation is a token.
+func rawTokens(text string) float64 {
+	tokens := 0.0
+	word := 0
+	flush := func() {
+		tokens += math.Ceil(float64(word) / 4)
+		word = 0
+	}
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			tokens++
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+			word++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
+
+// EstimateTokens estimates the tokens of text for the model, it's calibrated
+// by the token counts reported by the backend.
+func EstimateTokens(text string) int {
+	return int(math.Ceil(rawTokens(text) * math.Float64frombits(tokenRatio.Load())))
+}
+
+// observeTokens calibrates the estimation with the actual token count of
+// text.
+func observeTokens(text string, actual int) {
+	raw := rawTokens(text)
+	if raw < 100 || actual <= 0 {
+		// too short to be representative
+		return
+	}
+	sample := math.Max(0.5, math.Min(3, float64(actual)/raw))
+	for {
+		old := tokenRatio.Load()
+		ratio := math.Float64frombits(old)*0.8 + sample*0.2
+		if tokenRatio.CompareAndSwap(old, math.Float64bits(ratio)) {
+			return
+		}
+	}
+}
+
+func maxInputTokens() int {
+	if n := config.ReadConfig().Tokens.MaxInputTokens; n > 0 {
+		return n
+	}
+	return defaultMaxInputTokens
+}
+
+func maxOutputTokens(endpoint string) int {
+	if n := config.ReadConfig().Tokens.MaxOutputTokens; n > 0 {
+		return n
+	}
+	if n := config.GetGenerationConfig(endpoint).MaxOutputTokens; n != nil && *n > 0 {
+		return int(*n)
+	}
+	return defaultMaxOutputTokens
+}
+
+// outputBudget is the estimated output tokens allowed for a request, with
+// some room for the estimation error.
+func outputBudget(endpoint string) int {
+	return maxOutputTokens(endpoint) * 3 / 4
+}
+
+// outputTokens estimates the output tokens of translating the paragraph.
+func outputTokens(p string) int {
+	return int(float64(EstimateTokens(p))*outputExpansion) + paragraphOverhead
+}
+
+// chunkByTokens splits the index into chunks, so that the estimated output of
+// every chunk fits in the budget. A paragraph larger than the budget is a
+// chunk by itself.
+func chunkByTokens(input []string, index []int, budget int) [][]int {
+	var chunks [][]int
+	var chunk []int
+	sum := 0
+	for _, idx := range index {
+		n := outputTokens(input[idx])
+		if len(chunk) > 0 && sum+n > budget {
+			chunks = append(chunks, chunk)
+			chunk, sum = nil, 0
+		}
+		chunk = append(chunk, idx)
+		sum += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// checkPrompt makes sure that the prompt fits in the input limit of the
+// model, empty for the configured one. If "count_tokens" is enabled, the
+// tokens are counted by the backend when the estimation is close to the
+// limit, which also calibrates the estimation.
+func checkPrompt(ctx context.Context, backend Backend, model string, prompt string) error {
+	tokens := EstimateTokens(prompt)
+	limit := maxInputTokens()
+	tc, ok := backend.(TokenCounter)
+	if ok && config.ReadConfig().Tokens.CountTokens && tokens >= limit*3/4 {
+		n, err := tc.CountTokens(ctx, model, prompt)
+		if err != nil {
+			log.Warnf("failed to count tokens, use the estimation: %s", err)
+		} else {
+			log.Debugf("prompt tokens, estimated: %d, counted: %d", tokens, n)
+			observeTokens(prompt, n)
+			tokens = n
+		}
+	}
+	if tokens > limit {
+		return &BackendError{
+			Class: ErrFatal,
+			Err:   fmt.Errorf("the prompt has about %d tokens, exceeds the limit %d", tokens, limit),
+		}
+	}
+	return nil
+}
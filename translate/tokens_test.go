@@ -0,0 +1,90 @@
+package translate
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zjx20/hcfy-gemini/config"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	cases := map[string]int{
+		"":                    0,
+		"hello world":         4,
+		"你好，世界":               5,
+		"こんにちは":               5,
+		"translation, please": 6,
+	}
+	for text, expect := range cases {
+		if actual := EstimateTokens(text); actual != expect {
+			t.Errorf("bad tokens of %q, expected: %d, actual: %d", text, expect, actual)
+		}
+	}
+
+	defer tokenRatio.Store(math.Float64bits(1))
+	text := strings.Repeat("word ", 200)
+	observeTokens(text, 400)
+	if actual := EstimateTokens(text); actual <= 200 || actual >= 400 {
+		t.Errorf("the estimation should be calibrated towards 400, actual: %d", actual)
+	}
+}
+
+func TestChunkByTokens(t *testing.T) {
+	input := []string{"a", strings.Repeat("long ", 100), "b", "c"}
+	chunks := chunkByTokens(input, []int{0, 1, 2, 3}, 40)
+	expect := [][]int{{0}, {1}, {2, 3}}
+	if !reflect.DeepEqual(chunks, expect) {
+		t.Errorf("bad chunks, expected: %v, actual: %v", expect, chunks)
+	}
+}
+
+func TestRunChunks(t *testing.T) {
+	fake := useFakeBackend(t)
+	config.ReadConfig().Tokens.MaxOutputTokens = 40
+	t.Cleanup(func() {
+		config.ReadConfig().Tokens.MaxOutputTokens = 0
+	})
+	ch := make(chan *TranslateResult, 1)
+	Translate2(context.Background(), []string{"a", "b", "c"}, "中文", ch)
+	result := <-ch
+	if result.Err != nil {
+		t.Fatalf("unexpected error: %s", result.Err)
+	}
+	if expect := []string{"A", "B", "C"}; !reflect.DeepEqual(result.Resp.Result, expect) {
+		t.Errorf("bad result, expected: %q, actual: %q", expect, result.Resp.Result)
+	}
+	if expect := [][]string{{"a", "b"}, {"c"}}; !reflect.DeepEqual(fake.inputs, expect) {
+		t.Errorf("bad chunks, expected: %q, actual: %q", expect, fake.inputs)
+	}
+}
+
+// countingBackend counts the tokens by the estimation.
+type countingBackend struct {
+	fakeBackend
+	counted int
+}
+
+func (b *countingBackend) CountTokens(ctx context.Context, model string, prompt string) (int, error) {
+	b.counted++
+	return EstimateTokens(prompt), nil
+}
+
+func TestCheckPrompt(t *testing.T) {
+	config.ReadConfig().Tokens.CountTokens = true
+	config.ReadConfig().Tokens.MaxInputTokens = 100
+	t.Cleanup(func() {
+		config.ReadConfig().Tokens.CountTokens = false
+		config.ReadConfig().Tokens.MaxInputTokens = 0
+	})
+	backend := &countingBackend{}
+	if err := checkPrompt(context.Background(), backend, "", "hello"); err != nil || backend.counted != 0 {
+		t.Errorf("a short prompt should not be counted, err: %v, counted: %d", err, backend.counted)
+	}
+	long := strings.Repeat("hello world ", 100)
+	if err := checkPrompt(context.Background(), backend, "", long); err == nil || backend.counted != 1 {
+		t.Errorf("a prompt near the limit should be counted, err: %v, counted: %d", err, backend.counted)
+	}
+}
@@ -1,14 +1,24 @@
 package translate
 
 import (
+	"context"
 	"fmt"
+	"slices"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/zjx20/hcfy-gemini/config"
+	"github.com/zjx20/hcfy-gemini/util/lang"
 )
 
 const (
 	maxConcurrent = 100
+	// the default rounds to request the missing paragraphs again
+	defaultSalvageRetries = 2
+
+	// the names of the entries, for the endpoint specific config
+	EndpointHcfy  = "hcfy"
+	EndpointCjsfy = "cjsfy"
 )
 
 var sem = make(chan string, maxConcurrent)
@@ -19,25 +29,150 @@ func init() {
 	}
 }
 
+// goFire runs the session once a slot is available. The session is given up
+// if its context is done before that.
 func goFire(s *session) {
-	id := <-sem
+	var id string
+	select {
+	case id = <-sem:
+	case <-s.ctx.Done():
+		s.respCh <- &TranslateResult{Err: s.ctx.Err()}
+		return
+	}
 	defer func() {
 		sem <- id
 	}()
 	s.fire(id)
 }
 
-func Translate(req *TranslateReq, ch chan *TranslateResult) {
+func Translate(ctx context.Context, req *TranslateReq, ch chan *TranslateResult) {
 	req.Text = strings.TrimSpace(req.Text)
 	if len(req.Destination) == 0 || req.Text == "" {
 		log.Errorf("bad translate req: %+v", req)
 		return
 	}
-	s := newSession(req.Destination, strings.Split(req.Text, "\n"), ch)
-	go goFire(s)
+	opts := sessionOptions{
+		endpoint: EndpointHcfy,
+		source:   req.Source,
+	}
+	if req.allDestinations() {
+		translateAll(ctx, req.Destination, strings.Split(req.Text, "\n"), ch, opts)
+		return
+	}
+	startSession(ctx, req.Destination, strings.Split(req.Text, "\n"), ch, opts)
 }
 
-func Translate2(input []string, to string, ch chan *TranslateResult) {
-	s := newSession([]string{to}, input, ch)
-	go goFire(s)
+// translateAll translates the input into every destination in one session,
+// the input is repeated for each destination. A destination that the input is
+// already in is copied through. The result of the first destination is also
+// the result of the response.
+func translateAll(ctx context.Context, dest []string, input []string, ch chan *TranslateResult, opts sessionOptions) {
+	codes := lang.IsCode(dest[0])
+	source := strings.TrimSpace(opts.source)
+	if source == "" || strings.EqualFold(source, "auto") {
+		source = lang.Detect(protect(strings.Join(input, "\n")).text)
+	}
+	var remote, repeated, targets []string
+	for _, d := range dest {
+		if source != "" && lang.Same(lang.Code(source), lang.Code(d)) {
+			continue
+		}
+		remote = append(remote, d)
+		for _, p := range input {
+			repeated = append(repeated, p)
+			targets = append(targets, d)
+		}
+	}
+
+	merge := func(resp *TranslateResp) *TranslateResult {
+		merged := &TranslateResp{
+			Text: strings.Join(input, "\n"),
+		}
+		if source != "" {
+			merged.From = languageIn(source, codes)
+		} else if resp != nil {
+			merged.From = resp.From
+		}
+		n := 0
+		for _, d := range dest {
+			result := input
+			if n < len(remote) && remote[n] == d {
+				result = resp.Result[n*len(input) : (n+1)*len(input)]
+				n++
+			}
+			merged.Translations = append(merged.Translations, &DestTranslation{
+				To:     languageIn(d, codes),
+				Result: slices.Clone(result),
+			})
+		}
+		merged.To = merged.Translations[0].To
+		merged.Result = merged.Translations[0].Result
+		return &TranslateResult{Resp: merged}
+	}
+	if len(remote) == 0 {
+		ch <- merge(nil)
+		return
+	}
+
+	opts.source = source
+	opts.targets = targets
+	innerCh := make(chan *TranslateResult, 1)
+	startSession(ctx, remote, repeated, innerCh, opts)
+	go func() {
+		result := <-innerCh
+		if result.Err != nil {
+			ch <- result
+			return
+		}
+		if len(result.Resp.Result) != len(repeated) {
+			ch <- &TranslateResult{
+				Err: fmt.Errorf("number of translation result (%d) doesn't match the request (%d)",
+					len(result.Resp.Result), len(repeated)),
+			}
+			return
+		}
+		ch <- merge(result.Resp)
+	}()
+}
+
+// SettleSource detects the source language of the whole request if the
+// client doesn't tell it, so that the sub requests of the request are
+// translated into the same destination. It's left as is if undetected.
+func SettleSource(req *TranslateReq) {
+	if source := strings.TrimSpace(req.Source); source != "" && !strings.EqualFold(source, "auto") {
+		return
+	}
+	if code := lang.Detect(protect(req.Text).text); code != "" {
+		log.Debugf("detected source language of the request: %s", code)
+		req.Source = code
+	}
+}
+
+func Translate2(ctx context.Context, input []string, to string, ch chan *TranslateResult) {
+	Translate2Stream(ctx, input, to, nil, ch, nil)
+}
+
+// Translate2Options are the options given by a cjsfy request.
+type Translate2Options struct {
+	// Model overrides the configured model if not empty
+	Model string
+	// Generation overrides the generation parameters of the cjsfy endpoint
+	// with the fields set
+	Generation *config.GenerationConfig
+}
+
+// Translate2Stream is like Translate2 with the options, opts can be nil. It
+// also sends every translated paragraph to paraCh as soon as it's parsed from
+// the backend output if paraCh is not nil, like TranslateStream.
+func Translate2Stream(ctx context.Context, input []string, to string, opts *Translate2Options,
+	ch chan *TranslateResult, paraCh chan *Paragraph) {
+	sessOpts := sessionOptions{
+		endpoint: EndpointCjsfy,
+		paraCh:   paraCh,
+	}
+	if opts != nil {
+		sessOpts.model = opts.Model
+		sessOpts.generation = opts.Generation
+	}
+	startSession(ctx, []string{to}, input, ch, sessOpts)
 }
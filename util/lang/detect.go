@@ -0,0 +1,186 @@
+package lang
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// the minimal count of letters to make a guess
+	minLetters = 2
+	// the minimal trigram score to make a guess for the latin script, about
+	// a few frequent trigrams
+	minLatinScore = 60
+)
+
+// trigrams are the most frequent trigrams of the languages written in the
+// latin script, in descending order. A space stands for a word boundary.
+var trigrams = map[string][]string{
+	"en": {" th", "the", "he ", "ing", "and", " an", "nd ", " of", "of ", " to",
+		"ion", "ed ", "to ", "ent", " in", "er ", "tio", "is ", " is", "re ",
+		"you", " yo", "ou ", "at ", "it ", " it", "hat", "tha", "for", " fo"},
+	"fr": {"es ", " de", "de ", "ent", "le ", " le", "ion", " la", "la ", "les",
+		" et", "et ", "ons", "que", " qu", "ue ", "des", " co", "re ", "ne ",
+		" un", "une", "our", " po", "eur", "ait", " pa", "est", " es", "ans"},
+	"de": {"en ", "er ", "ch ", " de", "der", "ie ", "die", " di", "ein", "ich",
+		"sch", "nd ", "und", " un", "che", "den", " ei", "in ", "cht", "gen",
+		"ist", " is", "das", " da", "ung", "nic", "ht ", "te ", " zu", "auf"},
+	"es": {"de ", " de", "os ", " la", "la ", "el ", "es ", "en ", " el", "que",
+		" qu", "ue ", "as ", "ent", "ión", "del", " en", "aci", "los", " lo",
+		" co", "ado", "ara", " pa", "par", " se", "con", " es", "por", " po"},
+	"it": {" di", "di ", "to ", "la ", " la", "re ", "che", " ch", "del", "ell",
+		"ent", "one", "ion", "lla", "zio", "ne ", " co", " de", "le ", "per",
+		" pe", " il", "il ", "no ", "gli", " un", "ato", "are", "non", " no"},
+	"pt": {"de ", " de", "os ", "ão ", " qu", "que", "ue ", "do ", "ent", " co",
+		"da ", "as ", "es ", " a ", "ção", "em ", "ra ", "ar ", " do", "nto",
+		" da", " se", "com", "não", " nã", "uma", " um", "ara", " pa", "men"},
+	"nl": {"en ", "de ", " de", "an ", "het", " he", "et ", "ij ", "van", " va",
+		"ing", "een", " ee", "er ", "aar", "oor", "den", "nd ", "sch", " en",
+		"nie", " ni", "iet", " ge", "ver", " ve", "is ", " is", "dat", " da"},
+}
+
+// the characters only appear in one of the Chinese scripts, among the most
+// frequent ones
+var (
+	hansOnly = []rune("这个们来说时为会过对发后国经动进种现实还没开关样长么问")
+	hantOnly = []rune("這個們來說時為會過對發後國經動進種現實還沒開關樣長麼問")
+)
+
+// Detect guesses the language of text, returns the BCP 47 language tag, or
+// an empty string if it can't tell. The script of the letters decides the
+// language in most cases, the latin ones are told apart by the trigrams, and
+// short latin texts are usually left undecided.
+func Detect(text string) string {
+	var han, kana, hangul, cyrillic, arabic, thai, hebrew, greek, devanagari, latin int
+	var hans, hant, ukrainian int
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			han++
+			if containsRune(hansOnly, r) {
+				hans++
+			} else if containsRune(hantOnly, r) {
+				hant++
+			}
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+			if strings.ContainsRune("іїєґІЇЄҐ", r) {
+				ukrainian++
+			}
+		case unicode.Is(unicode.Arabic, r):
+			arabic++
+		case unicode.Is(unicode.Thai, r):
+			thai++
+		case unicode.Is(unicode.Hebrew, r):
+			hebrew++
+		case unicode.Is(unicode.Greek, r):
+			greek++
+		case unicode.Is(unicode.Devanagari, r):
+			devanagari++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+
+	counts := []struct {
+		code  string
+		count int
+	}{
+		// a CJK character outweighs a latin letter
+		{"zh", han * 3},
+		{"ja", kana * 3},
+		{"ko", hangul * 3},
+		{"ru", cyrillic},
+		{"ar", arabic},
+		{"th", thai},
+		{"he", hebrew},
+		{"el", greek},
+		{"hi", devanagari},
+		{"latin", latin},
+	}
+	best, total := 0, 0
+	for i, c := range counts {
+		total += c.count
+		if c.count > counts[best].count {
+			best = i
+		}
+	}
+	if total < minLetters {
+		return ""
+	}
+	switch code := counts[best].code; code {
+	case "zh":
+		// japanese mixes kanji and kana
+		if kana*5 >= han {
+			return "ja"
+		}
+		if hans > hant {
+			return "zh-Hans"
+		} else if hant > hans {
+			return "zh-Hant"
+		}
+		return "zh"
+	case "ru":
+		if ukrainian > 0 {
+			return "uk"
+		}
+		return code
+	case "latin":
+		return detectLatin(text)
+	default:
+		return code
+	}
+}
+
+// detectLatin scores the text against the trigram profiles, the higher
+// ranked trigrams weigh more.
+func detectLatin(text string) string {
+	var b strings.Builder
+	b.WriteByte(' ')
+	space := true
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+			space = false
+		} else if !space {
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	if !space {
+		b.WriteByte(' ')
+	}
+	normalized := b.String()
+
+	best, bestScore, secondScore := "", 0, 0
+	for _, code := range []string{"en", "fr", "de", "es", "it", "pt", "nl"} {
+		score := 0
+		profile := trigrams[code]
+		for rank, gram := range profile {
+			score += strings.Count(normalized, gram) * (len(profile) - rank)
+		}
+		if score > bestScore {
+			best, bestScore, secondScore = code, score, bestScore
+		} else if score > secondScore {
+			secondScore = score
+		}
+	}
+	// too short or too close to tell
+	if bestScore < minLatinScore || bestScore*4 < secondScore*5 {
+		return ""
+	}
+	return best
+}
+
+func containsRune(runes []rune, r rune) bool {
+	for _, x := range runes {
+		if x == r {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package lang
+
+import "testing"
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		text   string
+		expect string
+	}{
+		{"The quick brown fox jumps over the lazy dog.", "en"},
+		{"Le chat est sur la table, et il ne veut pas descendre.", "fr"},
+		{"Ich weiß nicht, ob das Wetter morgen schön ist.", "de"},
+		{"El perro de mi vecino ladra todas las noches.", "es"},
+		{"Non so se domani il tempo sarà bello per la gita.", "it"},
+		{"Eu não sei se vou conseguir chegar a tempo para a reunião.", "pt"},
+		{"Ik weet niet of het morgen mooi weer is.", "nl"},
+		{"这个问题我们明天再说", "zh-Hans"},
+		{"這個問題我們明天再說", "zh-Hant"},
+		{"明天", "zh"},
+		{"今日はいい天気ですね", "ja"},
+		{"오늘 날씨가 좋네요", "ko"},
+		{"Сегодня хорошая погода", "ru"},
+		{"Сьогодні гарна погода, і я йду гуляти", "uk"},
+		{"hello world", ""},
+		{"►", ""},
+		{"12345", ""},
+	}
+	for _, c := range cases {
+		if actual := Detect(c.text); actual != c.expect {
+			t.Errorf("bad language of %q, expected: %q, actual: %q", c.text, c.expect, actual)
+		}
+	}
+}
+
+func TestSame(t *testing.T) {
+	if !Same("zh", "zh-Hant") || !Same("zh-Hans", "zh-hans") {
+		t.Errorf("should be the same")
+	}
+	if Same("zh-Hans", "zh-Hant") || Same("en", "fr") {
+		t.Errorf("should not be the same")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	cases := []struct {
+		s      string
+		expect string
+	}{
+		{"英语", "en"},
+		{"English", "en"},
+		{"en-US", "en"},
+		{"中文 (简体)", "zh-Hans"},
+		{"中文（繁体）", "zh-Hant"},
+		{"zh_CN", "zh-Hans"},
+		{"zh-TW", "zh-Hant"},
+		{"Chinese (Simplified)", "zh-Hans"},
+		{"日本語", "ja"},
+		{"pt-BR", "pt"},
+	}
+	for _, c := range cases {
+		l := Lookup(c.s)
+		if l == nil || l.Code != c.expect {
+			t.Errorf("bad language of %q, expected: %s, actual: %+v", c.s, c.expect, l)
+		}
+	}
+	if l := Lookup("克林贡语"); l != nil {
+		t.Errorf("unexpected language: %+v", l)
+	}
+	if !IsCode("zh-CN") || !IsCode("en") || IsCode("english") || IsCode("英语") || IsCode("xx") {
+		t.Errorf("bad IsCode")
+	}
+}
@@ -0,0 +1,118 @@
+// Package lang detects the language of a text offline, and maps between the
+// language codes and the language names used by the clients.
+package lang
+
+import "strings"
+
+// Language is a language known by the registry.
+type Language struct {
+	// Code is the BCP 47 language tag, e.g. "en", "zh-Hans"
+	Code string
+	// Name is the name used by hcfy, also in the prompts
+	Name string
+	// Aliases are the other names of the language, e.g. in English or in the
+	// language itself
+	Aliases []string
+}
+
+var languages = []*Language{
+	{"zh", "中文", []string{"汉语", "chinese"}},
+	{"zh-Hans", "中文(简体)", []string{"简体中文", "中文简体", "简体", "chinese (simplified)", "simplified chinese", "zh-CN", "zh-SG"}},
+	{"zh-Hant", "中文(繁体)", []string{"繁体中文", "中文繁体", "繁體中文", "繁体", "繁體", "chinese (traditional)", "traditional chinese", "zh-TW", "zh-HK", "zh-MO"}},
+	{"en", "英语", []string{"英文", "english"}},
+	{"ja", "日语", []string{"日文", "japanese", "日本語"}},
+	{"ko", "韩语", []string{"韩文", "朝鲜语", "korean", "한국어"}},
+	{"fr", "法语", []string{"法文", "french", "français"}},
+	{"de", "德语", []string{"德文", "german", "deutsch"}},
+	{"es", "西班牙语", []string{"西班牙文", "spanish", "español"}},
+	{"it", "意大利语", []string{"意大利文", "italian", "italiano"}},
+	{"pt", "葡萄牙语", []string{"葡萄牙文", "portuguese", "português"}},
+	{"nl", "荷兰语", []string{"荷兰文", "dutch", "nederlands"}},
+	{"ru", "俄语", []string{"俄文", "russian", "русский"}},
+	{"uk", "乌克兰语", []string{"乌克兰文", "ukrainian", "українська"}},
+	{"pl", "波兰语", []string{"波兰文", "polish", "polski"}},
+	{"sv", "瑞典语", []string{"瑞典文", "swedish", "svenska"}},
+	{"tr", "土耳其语", []string{"土耳其文", "turkish", "türkçe"}},
+	{"vi", "越南语", []string{"越南文", "vietnamese", "tiếng việt"}},
+	{"id", "印尼语", []string{"印度尼西亚语", "indonesian", "bahasa indonesia"}},
+	{"ms", "马来语", []string{"马来文", "malay", "bahasa melayu"}},
+	{"ar", "阿拉伯语", []string{"阿拉伯文", "arabic", "العربية"}},
+	{"th", "泰语", []string{"泰文", "thai", "ไทย"}},
+	{"he", "希伯来语", []string{"希伯来文", "hebrew", "עברית"}},
+	{"el", "希腊语", []string{"希腊文", "greek", "ελληνικά"}},
+	{"hi", "印地语", []string{"印地文", "hindi", "हिन्दी"}},
+}
+
+// index maps the normalized codes and names to the languages
+var index = map[string]*Language{}
+
+func init() {
+	for _, l := range languages {
+		for _, s := range append([]string{l.Code, l.Name}, l.Aliases...) {
+			index[normalize(s)] = l
+		}
+	}
+}
+
+// normalize folds the case, the full-width parentheses and the spaces, so
+// that "中文 （简体）" matches "中文(简体)", and "zh_cn" matches "zh-CN".
+func normalize(s string) string {
+	s = strings.NewReplacer("（", "(", "）", ")", "_", "-").Replace(strings.ToLower(s))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Lookup finds the language by its code, hcfy name or alias, returns nil if
+// unknown. The region of a code is ignored if the code with the region is
+// unknown, e.g. "en-US" is "en".
+func Lookup(s string) *Language {
+	key := normalize(s)
+	if l, ok := index[key]; ok {
+		return l
+	}
+	if l, ok := index[strings.ReplaceAll(key, " ", "")]; ok {
+		return l
+	}
+	if base, _, ok := strings.Cut(key, "-"); ok {
+		return index[base]
+	}
+	return nil
+}
+
+// Name returns the hcfy name of the language s, or s itself if it's
+// unknown.
+func Name(s string) string {
+	if l := Lookup(s); l != nil {
+		return l.Name
+	}
+	return s
+}
+
+// Code returns the code of the language s, or s itself if it's unknown.
+func Code(s string) string {
+	if l := Lookup(s); l != nil {
+		return l.Code
+	}
+	return s
+}
+
+// IsCode reports whether s is a known language written as a code rather
+// than a name, e.g. "en" or "zh-CN".
+func IsCode(s string) bool {
+	base, _, _ := strings.Cut(normalize(s), "-")
+	if len(base) < 2 || len(base) > 3 || strings.Trim(base, "abcdefghijklmnopqrstuvwxyz") != "" {
+		return false
+	}
+	return Lookup(s) != nil
+}
+
+// Same reports whether the language codes a and b are the same language.
+// The script is only compared if both of them have one, e.g. "zh" is the
+// same as "zh-Hant", but "zh-Hans" is not.
+func Same(a string, b string) bool {
+	baseA, scriptA, _ := strings.Cut(a, "-")
+	baseB, scriptB, _ := strings.Cut(b, "-")
+	if !strings.EqualFold(baseA, baseB) {
+		return false
+	}
+	return scriptA == "" || scriptB == "" || strings.EqualFold(scriptA, scriptB)
+}
@@ -0,0 +1,79 @@
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type entry[K comparable, V any] struct {
+	key      K
+	value    V
+	expireAt time.Time
+}
+
+// Cache is a size-limited LRU cache, entries older than ttl are treated as
+// missing. It's safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	mu       sync.Mutex
+	maxItems int
+	ttl      time.Duration
+	ll       *list.List
+	items    map[K]*list.Element
+}
+
+// New creates a cache holding at most maxItems entries, a zero ttl means
+// entries never expire.
+func New[K comparable, V any](maxItems int, ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		maxItems: maxItems,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[K]*list.Element),
+	}
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return *new(V), false
+	}
+	e := el.Value.(*entry[K, V])
+	if !e.expireAt.IsZero() && time.Now().After(e.expireAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return *new(V), false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *Cache[K, V]) Put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var expireAt time.Time
+	if c.ttl > 0 {
+		expireAt = time.Now().Add(c.ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value = value
+		e.expireAt = expireAt
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&entry[K, V]{key: key, value: value, expireAt: expireAt})
+	for c.maxItems > 0 && c.ll.Len() > c.maxItems {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*entry[K, V]).key)
+	}
+}
+
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
@@ -0,0 +1,32 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEviction(t *testing.T) {
+	c := New[string, int](2, 0)
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Get("a")
+	c.Put("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("b should be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf("bad value of a: %d, %v", v, ok)
+	}
+	if c.Len() != 2 {
+		t.Errorf("bad len: %d", c.Len())
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c := New[string, int](2, 10*time.Millisecond)
+	c.Put("a", 1)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("a should be expired")
+	}
+}
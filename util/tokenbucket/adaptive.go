@@ -150,6 +150,25 @@ func (b *AdaptiveTokenBucket) tryConsume() (consumed bool, noToken bool, wait ti
 	return true, false, 0, ruleID
 }
 
+// Resize changes the capacity, the production increment and the consumption
+// rules of the bucket. Current tokens are capped by the new capacity.
+func (b *AdaptiveTokenBucket) Resize(maxTokens int, increment int, consRules []ConsumptionRule) {
+	if maxTokens <= 0 {
+		panic("maxTokens must be greater than 0")
+	}
+	if increment <= 0 {
+		panic("increment must be greater than 0")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxTokens = maxTokens
+	b.prodRule.Increment = increment
+	b.consRules = consRules
+	if b.currTokens > b.maxTokens {
+		b.currTokens = b.maxTokens
+	}
+}
+
 func (b *AdaptiveTokenBucket) Stop() {
 	b.stopOnce.Do(func() {
 		close(b.stopCh)